@@ -1,1094 +1,331 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
-	"fmt"
 	"image"
-	"image/color"
-	_ "image/gif"
-	_ "image/jpeg"
-	_ "image/png"
-    "embed"
+	"fmt"
 	"io"
 	"os"
-	"os/exec"
-	"strconv"
+	"runtime"
+	"runtime/pprof"
 	"strings"
-    "bytes"
-    "text/template"
-    "bufio"
-)
-
-// templates/macho64/main.tmpl
 
-const (
-    layoutsDir = "templates/layouts"
-    templatesDir = "templates"
+	"github.com/jasonhightower/go-piet/piet"
 )
 
-var (
-    //go:embed templates/macho64/main.tmpl
-    asmTemplateFS embed.FS
-
-//    mainTmpl embed.FS
-    asmTemplate *template.Template
-)
-
-func init() {
-    asmTemplate = template.Must(template.New("main.tmpl").Funcs(template.FuncMap{
-          "IsBlock": func(stmt Stmt) bool {
-              _, ok := stmt.(StmtBlock) 
-              return ok
-          },
-          "IsCall": func(stmt Stmt) bool {
-              _, ok := stmt.(Call)
-              return ok
-          },
-          "IsOp": func(stmt Stmt, op string) bool {
-              if _, ok := stmt.(Call); ok {
-                  return (stmt.(Call)).Op.String() == op
-              }
-              return false
-          },
-          "HasArgs": func(stmt Stmt) bool {
-              if _, ok := stmt.(Call); ok {
-                  return (stmt.(Call)).Op == Push
-              }
-              return false
-          },
-      }).ParseFS(asmTemplateFS, "templates/macho64/main.tmpl"))//, "templates/macho64/stmt.tmpl"))
-  //    baseLayout := template.Must(template.New("layout").ParseFS(mainTmpl, templateLayout))
-}
+// strictExitCode is used when -strict stops a program.
+const strictExitCode = 3
+// limitExitCode is used when -max-steps or -timeout stops a program.
+const limitExitCode = 4
+// failExitCode is used when a program fails for any other reason, like a
+// stack overflow or an error reading input or writing output.
+const failExitCode = 5
 
-type CodelImage struct {
-    img image.Image
-    csize int
-    bounds image.Rectangle
-}
-func NewCodelImage(img image.Image, codelSize int) *CodelImage {
-    rect := image.Rectangle{
-        Min: img.Bounds().Min.Div(codelSize),
-        Max: img.Bounds().Max.Div(codelSize),
-    }
-    return &CodelImage{
-        img: img,
-        csize: codelSize,
-        bounds: rect,
-    }
-}
-func (c CodelImage) At(x int, y int) color.Color {
-   return c.img.At(x * c.csize, y * c.csize ) 
-}
-func (c CodelImage) Bounds() image.Rectangle {
-    return c.bounds;
-}
-func (c CodelImage) ColorModel() color.Model {
-    return c.img.ColorModel()
-}
+func main() {
+    filename := flag.String("f", "", "name of the piet file to interpret (gif, png, jpeg, ppm or bmp)")
+    codelsizeFlag := flag.String("codel-size", "auto", "Size of codels to support enlarged images for better viewing (auto detects it from the image)")
+    capacity := flag.Int("capacity", 1 << 20, fmt.Sprintf("Most values the stack may hold, 4 bytes each, 0 for no limit, overflowing it stops with exit code %d", failExitCode))
+    samplingFlag := flag.String("codel-sampling", "topleft", "How a codel's color is read (topleft | strict | majority)")
+    unknownColor := flag.String("unknown-color", "white", "Handling of pixels that are not Piet colors (white | black | nearest | nearest-lab | error)")
+    mode := flag.String("m", "run", "(run | compile | normalize | minimize | test | diff | lint), test runs the golden programs in the -f directory, diff compares them across backends and lint reports likely mistakes")
+    output := flag.String("o", "", "name of the image written by normalize or minimize, defaults to <name>.normalized.png or <name>.min.png")
+    metricFlag := flag.String("metric", "area", "What minimize makes smaller (area | codels)")
+    inputsFlag := flag.String("inputs", "", "Comma separated files minimize runs the program on, the minimized program must print the same for each, defaults to empty input")
+    encodingFlag := flag.String("encoding", "utf8", "How characters are read and written by in(char) and out(char) (bytes | utf8)")
+    strict := flag.Bool("strict", false, fmt.Sprintf("Stop with exit code %d at ops the spec ignores, like stack underflow or division by zero", strictExitCode))
+    maxSteps := flag.Int("max-steps", 0, fmt.Sprintf("Stop with exit code %d after this many steps, 0 for no limit", limitExitCode))
+    timeout := flag.Duration("timeout", 0, fmt.Sprintf("Stop with exit code %d after running or tracing for compile this long, like 10s, 0 for no limit, a program waiting for input isn't stopped", limitExitCode))
+    cpuProfile := flag.String("cpuprofile", "", "Write a CPU profile to this file")
+    memProfile := flag.String("memprofile", "", "Write a heap profile to this file when the program ends")
+    optimize := flag.Int("O", 0, "Optimization level for run and compile, 0 for none, 1 folds constants and 2 also merges pushes")
+    formatFlag := flag.String("format", "text", "How lint reports issues (text | json)")
+    help := flag.Bool("h", false, "Print Help/Usage")
+    flag.Parse()
 
-type Dp byte
-const (
-    DpRight Dp = 0
-    DpDown Dp = 1
-    DpLeft Dp = 2
-    DpUp Dp = 3
-)
-func (d Dp) String() string {
-    switch d {
-    case DpRight:
-        return "right"
-    case DpLeft:
-        return "left"
-    case DpUp:
-        return "up"
-    case DpDown:
-        return "down"
-    default:
-        return "unknown"
+    if err := startProfiles(*cpuProfile, *memProfile); err != nil {
+        fmt.Println(err)
+        os.Exit(1)
     }
-}
-func (d Dp) Rotate(times int32) Dp {
-    return Dp((int32(d) + times) % 4)
-}
+    defer stopProfiles()
 
-type Cc byte
-const (
-    CcLeft Cc = 0
-    CcRight Cc = 1
-)
-func (c Cc) String() string {
-    if c == CcLeft {
-        return "left"
-    } else if c == CcRight {
-        return "right"
-    } else {
-        return "unknown"
-    }
-}
-func (c Cc) Toggle() Cc {
-    if c == CcLeft {
-        return CcRight
+    if *help == true {
+        flag.Usage()
+        exit(0)
     }
-    return CcLeft
-}
-
-type Op byte
-const (
-    Push Op = 1
-    Pop Op = 2
-    Add Op = 3
-    Sub Op = 4
-    Mult Op = 5
-    Div Op = 6
-    Mod Op = 7
-    Not Op = 8
-    Greater Op = 9
-    Pointer Op = 10
-    Switch Op = 11
-    Dup Op = 12
-    Roll Op = 13
-    NumIn Op = 14
-    CharIn Op = 15
-    NumOut Op = 16
-    CharOut Op = 17
-    Goto Op = 18
-    Noop = 19
-    Exit Op = 20
-)
-func (o Op) String() string {
-    switch o {
-    case Pop:
-        return "pop"
-    case Push:
-        return "push"
-    case Noop:
-        return "noop"
-    case Exit: 
-        return "exit"
-    case Add:
-        return "add"
-    case Sub:
-        return "sub"
-    case Mult:
-        return "mult"
-    case Div:
-        return "div"
-    case Mod:
-        return "mod"
-    case Not:
-        return "not"
-    case Greater:
-        return "greater"
-    case Pointer:
-        return "pointer"
-    case Switch:
-        return "switch"
-    case Dup:
-        return "dup"
-    case Roll:
-        return "roll"
-    case NumIn:
-        return "num_in"
-    case CharIn:
-        return "char_in"
-    case CharOut:
-        return "char_out"
-    case NumOut:
-        return "num_out"
-    default:
-        return fmt.Sprintf("Unknown operator %d", byte(o))
+    if *mode != "run" && *mode != "compile" && *mode != "normalize" && *mode != "minimize" && *mode != "test" && *mode != "diff" && *mode != "lint" {
+        fmt.Printf("Unrecogznied mode %s, expected one of (run, compile, normalize, minimize, test, diff, lint)\n", *mode)
+        exit(0)
     }
-}
-
-type Col byte 
-const (
-    LightRed Col = 0
-    MediumRed Col = 1
-    DarkRed Col = 2
-    LightYellow Col = 3
-    MediumYellow Col = 4
-    DarkYellow Col = 5
-    LightGreen Col = 6
-    MediumGreen Col = 7 
-    DarkGreen Col = 8
-    LightCyan Col = 9
-    MediumCyan Col = 10
-    DarkCyan Col = 11
-    LightBlue Col = 12
-    MediumBlue Col = 13
-    DarkBlue Col = 14
-    LightMagenta Col = 15
-    MediumMagenta Col = 16
-    DarkMagenta Col = 17
-    White Col = 18
-    Black Col = 19
-    Unrecoganized Col = 20
-)
-func (c Col) ToOp(o Col) Op {
-    if c == Black || o == Black || c == White || o == White {
-        return Noop
+    if *mode == "test" || *mode == "diff" {
+        dir := *filename
+        if dir == "" {
+            dir = "examples"
+        }
+        run := piet.RunGolden
+        if *mode == "diff" {
+            run = piet.RunDifferential
+        }
+        failed, err := run(dir, os.Stdout)
+        if err != nil {
+            fmt.Println(err)
+            exit(1)
+        }
+        if failed > 0 {
+            exit(1)
+        }
+        return
     }
-    c_hue := int(c) / 3
-    o_hue := int(o) / 3
-    hue_diff := DiffAndWrap(c_hue, o_hue, 6)
-
-    c_light := int(c) % 3
-    o_light := int(o) % 3
-    light_diff := DiffAndWrap(c_light, o_light, 3)
-
-    return Op(hue_diff * 3 + light_diff)
-}
-
-func DiffAndWrap(f int, s int, max int) int {
-    if s >= f {
-        return s - f
+    metric, err := piet.ParseMinimizeMetric(*metricFlag)
+    if err != nil {
+        fmt.Println(err)
+        exit(0)
     }
-    return s + max - f
-}
 
-func ColorToCol(c color.Color) Col {
-    if col, ok := colorToCol[c]; ok {
-        return col
+    encoding, err := piet.ParseEncoding(*encodingFlag)
+    if err != nil {
+        fmt.Println(err)
+        exit(0)
     }
-    return Unrecoganized
-}
-
-const zero uint8 = 0x00
-const mid uint8 = 0xC0
-const high uint8 = 0xFF
-var colorToCol = map[color.Color]Col {
-    color.RGBA{A:high}: Black,
-    color.RGBA{A:high, R: high, G: high, B: high}: White,
-
-    color.RGBA{A:high, R:high, G:mid, B:mid}: LightRed,
-    color.RGBA{A:high, R:high}:                 MediumRed,
-    color.RGBA{A:high, R:mid}:                  DarkRed,
-
-    color.RGBA{A:high, G:high, B:mid, R:mid}: LightGreen,
-    color.RGBA{A:high, G:high}:                 MediumGreen,
-    color.RGBA{A:high, G:mid}:                  DarkGreen,
-
-    color.RGBA{A:high, B:high, R:mid, G:mid}: LightBlue,
-    color.RGBA{A:high, B:high}:                 MediumBlue,
-    color.RGBA{A:high, B:mid}:                  DarkBlue,
-
-    color.RGBA{A:high, R:high, G:mid, B:high}:LightMagenta,
-    color.RGBA{A:high, R:high, B:high}:        MediumMagenta,
-    color.RGBA{A:high, R:mid, B:mid}:          DarkMagenta,
-
-    color.RGBA{A:high, R:high, G:high, B:mid}:LightYellow,
-    color.RGBA{A:high, R:high, G:high}:        MediumYellow,
-    color.RGBA{A:high, R:mid, G:mid}:          DarkYellow,
 
-    color.RGBA{A:high, R:mid, G:high, B:high}:LightCyan,
-    color.RGBA{A:high, G:high, B:high}:        MediumCyan,
-    color.RGBA{A:high, G:mid, B:mid}:          DarkCyan,
-}
-
-type PietTokens struct {
-    Bounds image.Rectangle
-    data [][]int
-    shapes []*Shape
-}
-func NewPietTokens(width int, height int) *PietTokens {
-    pietTokens := PietTokens{
-        Bounds: image.Rectangle{
-            Max: image.Point{X:width, Y:height},
-        },
-        data: make([][] int, width),
-        shapes: []*Shape{},
-    }
-    for x := 0; x < width; x++ {
-        pietTokens.data[x] = make([]int, height)
-        for y := 0; y < height; y++ {
-            pietTokens.data[x][y] = -1
-        }
+    policy, err := piet.ParseUnknownColorPolicy(*unknownColor)
+    if err != nil {
+        fmt.Println(err)
+        exit(0)
     }
-    return &pietTokens
-}
-func (p *PietTokens) Width() int {
-    return len(p.data)
-}
-func (p *PietTokens) Height() int {
-    return len(p.data[0])
-}
-func (p *PietTokens) Size() int {
-    return len(p.shapes)
-}
-func (p *PietTokens) At(x int, y int) *Shape {
-    if p.data == nil || x < 0 || y < 0 || x >= len(p.data) || p.data[x] == nil || y >= len(p.data[x]) {
-        return nil
+    codelsize, err := piet.ParseCodelSize(*codelsizeFlag)
+    if err != nil {
+        fmt.Println(err)
+        exit(0)
     }
-    if p.data[x][y] == -1 {
-        return nil
+    sampling, err := piet.ParseCodelSampling(*samplingFlag)
+    if err != nil {
+        fmt.Println(err)
+        exit(0)
     }
-    return p.shapes[p.data[x][y]]
-}
-func (p *PietTokens) Add(s *Shape) {
-    p.shapes = append(p.shapes, s)
-}
-func Tokenize(img image.Image) *PietTokens {
-    pietTokens := NewPietTokens(img.Bounds().Max.X, img.Bounds().Max.Y)
 
-    pos := image.Point{X:0,Y:0}
-    for pos.X = 0; pos.X < img.Bounds().Max.X; pos.X++ {
-        for pos.Y = 0; pos.Y < img.Bounds().Max.Y; pos.Y++ {
-            if pietTokens.data[pos.X][pos.Y] == -1 {
-                shape := Shape{
-                    Color: ColorToCol(img.At(pos.X, pos.Y)),
-                }
-                shape.AddPoint(pos)
-                idx := len(pietTokens.shapes)
-                pietTokens.data[pos.X][pos.Y] = idx
-                pietTokens.Add(&shape)
-                fillLeft(img, pos, &shape, pietTokens)
-                fillRight(img, pos, &shape, pietTokens)
-                fillUp(img, pos, &shape, pietTokens)
-                fillDown(img, pos, &shape, pietTokens)
-            }         
+    if *mode == "normalize" {
+        unknownSet := false
+        flag.Visit(func(f *flag.Flag) {
+            unknownSet = unknownSet || f.Name == "unknown-color"
+        })
+        if !unknownSet {
+            policy = piet.UnknownNearest
+        }
+        if err := normalize(*filename, *output, policy, codelsize); err != nil {
+            io.WriteString(os.Stderr, fmt.Sprint(err))
+            exit(1)
         }
-    }
-
-    return pietTokens
-}
-
-// TODO JH optimize this
-func fillLeft(img image.Image, pos image.Point, shape *Shape, pietTokens *PietTokens) {
-    pos.X -= 1
-    if !pos.In(img.Bounds()) {
-        return
-    }
-    if pietTokens.data[pos.X][pos.Y] != -1 {
-        return
-    }
-    colAtPos := ColorToCol(img.At(pos.X, pos.Y))
-    if shape.Color != colAtPos {
-        return
-    }                
-    pietTokens.data[pos.X][pos.Y] = len(pietTokens.shapes) - 1
-    shape.AddPoint(pos)
-    fillLeft(img, pos, shape, pietTokens)
-    fillUp(img, pos, shape, pietTokens)
-    fillDown(img, pos, shape, pietTokens)
-}
-func fillUp(img image.Image, pos image.Point, shape *Shape, pietTokens *PietTokens) {
-    pos.Y -= 1
-    if !pos.In(img.Bounds()) {
-        return
-    }
-    if pietTokens.data[pos.X][pos.Y] != -1 {
-        return
-    }
-    colAtPos := ColorToCol(img.At(pos.X, pos.Y))
-    if shape.Color != colAtPos {
-        return
-    }
-    pietTokens.data[pos.X][pos.Y] = len(pietTokens.shapes) - 1
-    shape.AddPoint(pos)
-    fillUp(img, pos, shape, pietTokens)
-    fillLeft(img, pos, shape, pietTokens)
-    fillRight(img, pos, shape, pietTokens)
-}
-func fillRight(img image.Image, pos image.Point, shape *Shape, pietTokens *PietTokens) {
-    pos.X += 1
-    if !pos.In(img.Bounds()) {
-        return
-    }
-    if pietTokens.data[pos.X][pos.Y] != -1 {
-        return
-    }
-    colAtPos := ColorToCol(img.At(pos.X, pos.Y))
-    if shape.Color != colAtPos {
-        return
-    }
-    pietTokens.data[pos.X][pos.Y] = len(pietTokens.shapes) - 1
-    shape.AddPoint(pos)
-    fillRight(img, pos, shape, pietTokens)
-    fillUp(img, pos, shape, pietTokens)
-    fillDown(img, pos, shape, pietTokens)
-}
-func fillDown(img image.Image, pos image.Point, shape *Shape, pietTokens *PietTokens) {
-    pos.Y += 1
-    if !pos.In(img.Bounds()) {
-        return
-    }
-    if pietTokens.data[pos.X][pos.Y] != -1 {
-        return
-    }
-    colAtPos := ColorToCol(img.At(pos.X, pos.Y))
-    if shape.Color != colAtPos {
         return
     }
-    pietTokens.data[pos.X][pos.Y] = len(pietTokens.shapes) - 1
-    shape.AddPoint(pos)
-    fillDown(img, pos, shape, pietTokens)
-    fillLeft(img, pos, shape, pietTokens)
-    fillRight(img, pos, shape, pietTokens)
-}
 
-type Shape struct {
-    Color Col
-    Size int32
-    xEdges *TreeNode
-    yEdges *TreeNode
-}
-func (s *Shape) AddPoint(p image.Point) {
-    s.Size += 1
-    if s.Size == 1 {
-        s.xEdges = NewTreeNode(p.X, p.Y)
-        s.yEdges = NewTreeNode(p.Y, p.X)
-    } else {
-        s.xEdges.Add(p.X, p.Y)
-        s.yEdges.Add(p.Y, p.X)
-    }
-}
-
-type Node struct {
-    x, y int
-}
-
-type Instr struct {
-    Op Op
-    Data uint32
-}
-type Stack [C any] struct {
-    data []C
-    head int
-    capacity int
-}
-func NewIntStack(capacity int) *Stack [int32] {
-    return &Stack [int32]{
-        data: make([]int32, capacity),
-        head: -1,
-        capacity: capacity,
-    }
-}
-func (s Stack[C]) String() string {
-    result := fmt.Sprint("[")
-    for i := 0; i <= s.head; i++ {
-        if i > 0 {
-            result += fmt.Sprintf(", %d", s.data[i])
-        } else {
-            result += fmt.Sprint(s.data[i])
+    loadOpts := piet.LoadOptions{CodelSize: codelsize, Sampling: sampling, UnknownColor: policy}
+    img, err := piet.ReadImage(*filename)
+    if err == nil && *mode == "lint" {
+        found, err := lint(img, loadOpts, *formatFlag)
+        if err != nil {
+            io.WriteString(os.Stderr, fmt.Sprint(err))
+            exit(1)
+        }
+        if found > 0 {
+            exit(1)
         }
-    }
-    result += "]"
-    return result
-}
-func (s *Stack[C]) Len() int {
-    return s.head + 1
-}
-func (s *Stack[C]) Roll(depth int32, rolls int32) {
-    if s.Len() <= 1 || int(depth) > s.Len() {
         return
     }
-    min := s.Len() - int(depth)
-    s.Reverse(min, s.Len())
-
-    rolls = rolls % depth
-    mid := min + int(rolls)
-    s.Reverse(min, mid)
-    s.Reverse(mid, s.Len())
-}
-
-func (s *Stack[C]) Reverse(from int, to int) {
-    to -= 1
-    count := (to - from )/ 2
-    for i := 0; i < count; i++ {
-        s.Swap(from + i, to - i)
-    }
-}
-
-func (s *Stack[C]) Swap(source int, target int) {
-    tmp := s.data[target]
-    s.data[target] = s.data[source]
-    s.data[source] = tmp
-}
-
-func (s *Stack[C]) Push(val C) {
-    s.head += 1
-    if s.head >= s.capacity {
-        panic("Stack overflow")
-    }
-    s.data[s.head] = val
-}
-func (s *Stack[C]) Pop() (C, bool) {
-    if s.head < 0 {
-        var result C
-        return result, false
+    var prog *piet.Program
+    if err == nil {
+        prog, err = piet.LoadWith(img, loadOpts)
     }
-    val := s.data[s.head]
-    s.head -= 1
-    return val, true
-}
-func (s *Stack[C]) Pop2() (C, C, bool) {
-    if s.head < 1 {
-        var result C
-        return result, result, false
+    if err != nil {
+        io.WriteString(os.Stderr, fmt.Sprint(err))
+        exit(1)
     }
-    val := s.data[s.head]
-    val2 := s.data[s.head - 1]
-    s.head -= 2
-    return val, val2, true
-}
-func (s *Stack[C]) Peek() (C, bool) {
-    if s.head < 0 {
-        var result C
-        return result, false
+    if codelsize == 0 && prog.CodelSize() == 1 && sampling != piet.SampleTopLeft {
+        fmt.Fprintf(os.Stderr, "warning: detected a codel size of 1 so -codel-sampling %s has no effect, noisy images need -codel-size\n", sampling)
     }
-    return s.data[s.head], true
-}
-func (s *Stack[C]) Dup() bool {
-    if s.head + 1 >= s.capacity {
-        panic("Stack overflow")
+    if size := prog.CodelSize(); size > 1 && sampling == piet.SampleTopLeft {
+        if mismatches := piet.CodelMismatches(img, size); len(mismatches) > 0 {
+            fmt.Fprintf(os.Stderr, "warning: %d codels of size %d contain more than one color, the first at (%d, %d)\n",
+                len(mismatches), size, mismatches[0].X, mismatches[0].Y)
+        }
     }
-    if s.head < 0 {
-        return false
+    if *mode == "minimize" {
+        if err := minimize(prog, *filename, *output, *capacity, metric, *inputsFlag); err != nil {
+            io.WriteString(os.Stderr, fmt.Sprint(err))
+            exit(1)
+        }
+        return
     }
-    s.head += 1
-    s.data[s.head] = s.data[s.head -1]
-    return true
-}
 
-func readImage(filename string) (image.Image, error) {
-    file, err := os.Open(filename)
-    if err != nil {
-        // FIXME proper error handling
-        return nil, err
+    opts := piet.Options{Capacity: *capacity, Strict: *strict, Encoding: encoding, MaxSteps: *maxSteps, Optimize: *optimize}
+    ctx := context.Background()
+    if *timeout > 0 {
+        var cancel context.CancelFunc
+        ctx, cancel = context.WithTimeout(ctx, *timeout)
+        defer cancel()
     }
-    defer file.Close()
-
-    image, _, err := image.Decode(file)
-    return image, err
-}
-
-func InBounds(x int, y int, width int, height int) bool {
-    return x >= 0 && y >= 0 && x < width && y < height
-}
-
-type TreeNode struct {
-    Key int
-    Min int
-    Max int
-    Left *TreeNode
-    Right *TreeNode
-}
-func NewTreeNode(key int, val int) *TreeNode {
-    return &TreeNode{Key: key, Min: val, Max: val}
-}
-func (t *TreeNode) Get(key int) (*TreeNode, bool) {
-    if t.Key == key {
-        return t, true
-    } else if t.Key < key {
-        if t.Right == nil {
-            return nil, false
+    if *mode == "compile" {
+        segments := strings.Split(*filename, "/")
+        name := strings.Split(segments[len(segments) - 1], ".")[0]
+        if err := compile(ctx, prog, name, opts); err != nil {
+            fmt.Println(err)
+            if errors.Is(err, piet.ErrMaxSteps) || errors.Is(err, context.DeadlineExceeded) {
+                exit(limitExitCode)
+            }
+            exit(1)
         }
-        return t.Right.Get(key)
     } else {
-        if t.Left == nil {
-            return nil, false
+        if _, err := piet.Run(ctx, prog, os.Stdin, os.Stdout, opts); err != nil {
+            fmt.Fprintf(os.Stderr, "\n%s\n", err)
+            exit(runExitCode(err, *strict))
         }
-        return t.Left.Get(key)
     }
 }
-func (t *TreeNode) MinNode() (*TreeNode) {
-    if t.Left != nil {
-        return t.Left.MinNode()
+
+// runExitCode is the exit code for an error returned by piet.Run.
+func runExitCode(err error, strict bool) int {
+    if _, ok := err.(piet.LimitError); ok {
+        return limitExitCode
     }
-    return t
-}
-func (t *TreeNode) MaxNode() (*TreeNode) {
-    if t.Right != nil {
-        return t.Right.MaxNode()
+    if _, ok := err.(piet.Error); ok && strict {
+        return strictExitCode
     }
-    return t
+    return failExitCode
 }
-func (t *TreeNode) Add(key int, val int) {
-    if t.Key == key {
-        if t.Min > val {
-            t.Min = val
-        }
-        if t.Max < val {
-            t.Max = val
-        }
-    } else if t.Key < key {
-        if t.Right == nil {
-            t.Right = NewTreeNode(key, val)
-        } else {
-            t.Right.Add(key, val)
-        }
-    } else {
-        if t.Left == nil {
-            t.Left = NewTreeNode(key, val)
-        } else {
-            t.Left.Add(key, val)
-        }
-    }
-}
-
-func ParseStmt(tokens *PietTokens, capacity int) Stmt {
-    dp := DpRight
-    cc := CcLeft
-
-    carrot := Carrot{X:0, Y:0, tokens: tokens}
-
-    root := StmtBlock{}
-    stack := NewIntStack(capacity)
 
-    curShape := carrot.CurrentShape()
+// stopProfiles finishes the profiles started by startProfiles.
+var stopProfiles = func() {}
 
-    attempts := 8
-    for true {
-        ok := carrot.Move(dp, cc)
-        if !ok {
-            attempts -= 1
-            if attempts == 0 {
-                root.Append(Call{Op:Exit})
-                return root
-            }
-            root.Append(Call{Op: Push, Args: []int32 {1}})
-            if attempts % 2 > 0 {
-                root.Append(Call{Op: Switch})
-                cc = cc.Toggle()
-            } else {
-                root.Append(Call{Op: Pointer})
-                dp = dp.Rotate(1)
-            }
-            continue
+// startProfiles starts a CPU profile and arranges for a heap profile to be
+// written by stopProfiles, either file name may be empty.
+func startProfiles(cpuProfile string, memProfile string) error {
+    var cpu *os.File
+    if cpuProfile != "" {
+        var err error
+        if cpu, err = os.Create(cpuProfile); err != nil {
+            return err
         }
-        nextShape := carrot.CurrentShape()
-        if nextShape.Color == White {
-            root.Append(Call{Op: Push, Args: []int32 {1}})
-            root.Append(Call{Op: Dup})
-            root.Append(Call{Op: Switch})
-            root.Append(Call{Op: Pointer})
-            attempts -= 2
-            curShape = nextShape
-            continue
+        if err := pprof.StartCPUProfile(cpu); err != nil {
+            cpu.Close()
+            return err
         }
-
-//        fmt.Printf("Move to (%d, %d) - %s %s : [%d]\n", carrot.X, carrot.Y, dp, cc, curShape.Size)
-        op := curShape.Color.ToOp(nextShape.Color)
-//        fmt.Println(op)
-        attempts = 8
-        switch op {
-        case Switch: 
-            if val, ok := stack.Pop(); ok {
-               root.Append(Call{Op:Pointer})
-               if val % 2 > 0 {
-                   cc = cc.Toggle()
-               }
-            }
-        case Pointer:
-            if val, ok := stack.Pop(); ok {
-                root.Append(Call{Op:Switch})
-                dp = dp.Rotate(val)
-            }
-        case Push: 
-            stack.Push(curShape.Size)
-            root.Append(Call{Op: op, Args: []int32 {curShape.Size}})
-        case Add: 
-            if f, s, ok := stack.Pop2(); ok {
-               root.Append(Call{Op: op})
-               stack.Push(s + f)
-            }
-        case Sub: 
-            if f, s, ok := stack.Pop2(); ok {
-                root.Append(Call{Op: op})
-                stack.Push(s - f)
-            }
-        case Mult:
-            if f, s, ok := stack.Pop2(); ok {
-                root.Append(Call{Op: op})
-                stack.Push(s * f)
-            }
-        case Div:
-            if f, s, ok := stack.Pop2(); ok {
-                root.Append(Call{Op: op})
-                stack.Push(s / f)
-            }
-        case NumOut:
-            stack.Pop()
-            root.Append(Call{Op: op})
-        case CharOut:
-            stack.Pop()
-            root.Append(Call{Op: op})
-        case NumIn:
-            stack.Push(-1) // TODO JH this should be an object that indicates unknown input
-            root.Append(Call{Op: op})
-        case CharIn:
-            stack.Push(-1) // TODO JH this should be an object that indicates unknown input
-            root.Append(Call{Op: op})
-        case Roll:
-            if f, s, ok := stack.Pop2(); ok {
-                root.Append(Call{Op: op})
-                stack.Roll(s, f)
-            }
-        case Pop:
-            if _, ok := stack.Pop(); ok {
-                root.Append(Call{Op: op})
-            }
-        case Dup:
-            if val, ok := stack.Peek(); ok {
-                root.Append(Call{Op: op})
-                stack.Push(val)
-            }
-        case Greater:
-            if f, s, ok := stack.Pop2(); ok {
-                root.Append(Call{Op: op})
-                if s > f {
-                    stack.Push(1)
-                } else {
-                    stack.Push(0)
-                }
+    }
+    stopProfiles = func() {
+        if cpu != nil {
+            pprof.StopCPUProfile()
+            cpu.Close()
+        }
+        if memProfile != "" {
+            f, err := os.Create(memProfile)
+            if err != nil {
+                fmt.Fprintln(os.Stderr, err)
+                return
             }
-        case Mod:
-            if f, s, ok := stack.Pop2(); ok {
-                root.Append(Call{Op: op})
-                stack.Push(s % f)
+            defer f.Close()
+            runtime.GC()
+            if err := pprof.WriteHeapProfile(f); err != nil {
+                fmt.Fprintln(os.Stderr, err)
             }
-        case Noop:
-        default:
-            panic(fmt.Sprintf("Unhandled operator %s", op))
         }
-        curShape = nextShape
+        stopProfiles = func() {}
     }
-
-    return root
+    return nil
 }
 
-type Carrot struct {
-    X, Y int
-    tokens *PietTokens
+// exit finishes the profiles before exiting, os.Exit skips deferred calls.
+func exit(code int) {
+    stopProfiles()
+    os.Exit(code)
 }
-func (c *Carrot) CurrentShape() *Shape {
-    return c.tokens.At(c.X, c.Y)
-}
-func (c *Carrot) slideWhite(dp Dp, cc Cc) bool {
-    xAdj, yAdj := 0, 0
-    switch dp {
-    case DpRight:
-        xAdj = 1
-    case DpDown:
-        yAdj = 1
-    case DpLeft:
-        xAdj = -1
-    case DpUp:
-        xAdj = 1
+
+func compile(ctx context.Context, prog *piet.Program, name string, opts piet.Options) error {
+    asmName := fmt.Sprintf("%s.asm", name)
+    f, err := os.Create(asmName)
+    if err != nil {
+        return err
     }
-    curShape := c.tokens.At(c.X, c.Y)
-    width, height := c.tokens.Width(), c.tokens.Height()
-    for InBounds(c.X + xAdj, c.Y + yAdj, width, height) {
-        c.X += xAdj
-        c.Y += yAdj
-        if c.tokens.At(c.X, c.Y) != curShape {
-            if curShape.Color == Black {
-                c.X -= xAdj
-                c.Y -= yAdj
-                return false
-            }
-            return true
-        }
+    defer f.Close()
+    if err := piet.Compile(ctx, prog, f, opts); err != nil {
+        return err
     }
-    return false
+    return piet.Assemble(asmName, name)
 }
-func (c *Carrot) Move(dp Dp, cc Cc) bool {
-    xPos, yPos := c.X, c.Y
-    curShape := c.tokens.At(c.X, c.Y)
-    if curShape.Color == White {
-        return c.slideWhite(dp, cc)
-    }
-    switch dp {
-    case DpRight:
-        rightNode := curShape.xEdges.MaxNode()
-        xPos = rightNode.Key
-        if cc == CcLeft {
-            yPos = rightNode.Min
-        } else {
-            yPos = rightNode.Max
-        }
-        xPos += 1
-    case DpDown:
-        bottomNode := curShape.yEdges.MaxNode()
-        yPos = bottomNode.Key
-        if cc == CcLeft {
-            xPos = bottomNode.Max
-        } else {
-            xPos = bottomNode.Min
-        }
-        yPos += 1
-    case DpLeft:
-        leftNode := curShape.xEdges.MinNode()
-        xPos = leftNode.Key
-        if cc == CcLeft {
-            yPos = leftNode.Max
-        } else {
-            yPos = leftNode.Min
-        }
-        xPos -= 1
-    case DpUp:
-        topNode := curShape.yEdges.MinNode()
-        yPos = topNode.Key
-        if cc == CcLeft {
-            xPos = topNode.Min
-        } else {
-            xPos = topNode.Max
-        }
-        yPos -= 1
-    }
-    if InBounds(xPos, yPos, c.tokens.Width(), c.tokens.Height()) {
-        if c.tokens.At(xPos, yPos).Color == Black {
-            return false
-        }
-        c.X = xPos
-        c.Y = yPos
-        return true
+
+func outputName(filename string, output string, suffix string) string {
+    if output != "" {
+        return output
     }
-    return false
+    segments := strings.Split(filename, "/")
+    name := strings.Split(segments[len(segments) - 1], ".")[0]
+    return fmt.Sprintf("%s.%s.png", name, suffix)
 }
 
-func main() {
-    filename := flag.String("f", "", "name of the piet file to interpret")
-    codelsize := flag.Int("codel-size", 1, "Size of codels to support enlarged images for better viewing")
-    capacity := flag.Int("capacity", 512, "Capacity of the stack")
-    mode := flag.String("m", "run", "(run | compile)")
-    help := flag.Bool("h", false, "Print Help/Usage")
-    flag.Parse()
-
-    if *help == true {
-        flag.Usage()
-        os.Exit(0)
+func minimize(prog *piet.Program, filename string, output string, capacity int, metric piet.MinimizeMetric, inputFiles string) error {
+    inputs := [][]byte{}
+    if inputFiles != "" {
+        for _, name := range strings.Split(inputFiles, ",") {
+            input, err := os.ReadFile(name)
+            if err != nil {
+                return err
+            }
+            inputs = append(inputs, input)
+        }
     }
-    if *mode != "run" && *mode != "compile" {
-        fmt.Printf("Unrecogznied mode %s, expected one of (run, compile)\n", *mode)
-        os.Exit(0)
+    pietImage := piet.PietImageFromTokens(prog.Tokens())
+    minimized, err := piet.Minimize(pietImage, capacity, metric, inputs)
+    if err != nil {
+        return err
     }
-
-    img, err := readImage(*filename)
+    output = outputName(filename, output, "min")
+    f, err := os.Create(output)
     if err != nil {
-        io.WriteString(os.Stderr, fmt.Sprint(err))
-        os.Exit(1)
-    } else {
-        if *codelsize > 1 {
-            img = NewCodelImage(img, *codelsize)
-        }
+        return err
     }
-    tokens := Tokenize(img)
-    stmt := ParseStmt(tokens, *capacity)
-
-    if *mode == "compile" {
-        segments := strings.Split(*filename, "/")
-        name := strings.Split(segments[len(segments) - 1], ".")[0]
-
-        tmplName := fmt.Sprintf("%s.asm", name)
-        tmplF, err := os.Create(tmplName)
-        if err != nil {
-            panic(err)
-        }
-        defer tmplF.Close()
-        CompileTmpl(stmt, tmplF)
-
-        // nasm -fmacho64 tetris.asm
-        cmd := exec.Command("nasm", "-fmacho64", tmplName)
-        _, err = cmd.Output()
-        if err != nil {
-            // if there was any error, print it here
-            panic(err)
-        } else {
-            cmd = exec.Command("xcode-select", "-p")
-            xcodePath, err := cmd.Output()
-            if err != nil {
-                panic(err)
-            }
-            xcodePathStr := strings.TrimSpace(string(xcodePath))
-            objFile := fmt.Sprintf("%s.o", name)
-    // ld -e _main  -macosx_version_min 10.10 -arch x86_64 -lSystem -L$(xcode-select -p)/SDKs/MacOSX.sdk/usr/lib -o tetris tetris.o
-            cmd = exec.Command("ld", "-v", 
-                                      "-e", 
-                                      "_main", 
-                                      "-macosx_version_min",
-                                      "10.10", 
-                                      "-arch",
-                                      "x86_64",
-                                      "-lSystem",
-                                      fmt.Sprintf("-L%s/SDKs/MacOSX.sdk/usr/lib", xcodePathStr),
-                                      "-o",
-                                      name,
-                                      objFile)
-
-            var out bytes.Buffer
-            var stderr bytes.Buffer
-            cmd.Stdout = &out
-            cmd.Stderr = &stderr
-            err = cmd.Run()
-            if err != nil {
-                fmt.Println(fmt.Sprint(err) + ": " + stderr.String())
-                return
-            }
-            // ld -e _main  -macosx_version_min 10.10 -arch x86_64 -lSystem -L$(xcode-select -p)/SDKs/MacOSX.sdk/usr/lib -o tetris tetris.o*
-        }
-    } else {
-        interpreter := NewInterpreter(*capacity)
-        interpreter.Interpret(stmt)
+    defer f.Close()
+    if err := piet.EncodePNG(f, minimized, 1); err != nil {
+        return err
     }
-    // compile ... 
-}
-
-/*
-[Stmt]        | (Assign | Call | If)
-[Assign]      | Name Int
-[If]          | EqExpr Block Stmt?
-[EqExpr]      | Name Int
-[Block]       | Stmt+
-[Call]        | Name Int?
-[Int]         | (int32)
-*/
-
-type AstNode interface {
-}
-type Stmt interface {
-    AstNode
-}
-type Assign struct {
-    Name string
-    val int32    
-}
-type StmtBlock struct {
-    Children []Stmt
-}
-func (s *StmtBlock) Append(stmt Stmt) {
-    s.Children = append(s.Children, stmt)
-}
-type StmtIf struct {
-    Condition EqExpr
-    Block StmtBlock
-    Else Stmt
-}
-type EqExpr struct {
-    Name string
-    val int32
-}
-type Call struct {
-    Op Op
-    Args []int32
+    fmt.Printf("%dx%d codels (%d non-black) -> %dx%d codels (%d non-black)\n",
+        pietImage.Width(), pietImage.Height(), pietImage.CodelCount(),
+        minimized.Width(), minimized.Height(), minimized.CodelCount())
+    fmt.Printf("wrote %s\n", output)
+    return nil
 }
 
-type Interpreter struct {
-    Dp Dp
-    Cc Cc
-    Stack *Stack[int32]
-    Input *bufio.Reader
-}
-func NewInterpreter(capacity int) *Interpreter {
-    return &Interpreter{
-        Stack: NewIntStack(capacity),
-        Input: bufio.NewReader(os.Stdin),
+func normalize(filename string, output string, policy piet.UnknownColorPolicy, codelsize int) error {
+    img, err := piet.ReadImage(filename)
+    if err != nil {
+        return err
     }
-}
-
-func (interpreter *Interpreter) Interpret(stmt Stmt) {
-    if stmt == nil {
-        return
+    pietImage, report, err := piet.Normalize(img, policy, codelsize)
+    if err != nil {
+        return err
     }
-    if assign, ok := stmt.(Assign); ok {
-        if assign.Name == "dp" {
-            interpreter.Dp = Dp(assign.val)
-        } else if assign.Name == "cc" {
-            interpreter.Cc = Cc(assign.val)
-        }
-    } else if block, ok := stmt.(StmtBlock); ok {
-        if block.Children != nil {
-            for _, s := range block.Children {
-                interpreter.Interpret(s)
-            }
-        }
-    } else if call, ok := stmt.(Call); ok {
-        switch call.Op {
-            case Push:
-                interpreter.Stack.Push(call.Args[0])
-            case Pop:
-                interpreter.Stack.Pop()
-            case Add:
-                if f, s, ok := interpreter.Stack.Pop2(); ok {
-                    interpreter.Stack.Push(s + f)
-                }
-            case Sub:
-                if f, s, ok := interpreter.Stack.Pop2(); ok {
-                    interpreter.Stack.Push(s - f)
-                }
-            case Mult:
-                if f, s, ok := interpreter.Stack.Pop2(); ok {
-                    interpreter.Stack.Push(s * f)
-                }
-            case Div:
-                if f, s, ok := interpreter.Stack.Pop2(); ok {
-                    interpreter.Stack.Push(s / f)
-                }
-            case Dup:
-                if val, ok := interpreter.Stack.Peek(); ok {
-                    interpreter.Stack.Push(val)
-                }
-            case Greater:
-                if f, s, ok := interpreter.Stack.Pop2(); ok {
-                    if s > f {
-                        interpreter.Stack.Push(1)
-                    } else {
-                        interpreter.Stack.Push(0)
-                    }
-                }
-            case Switch:
-                if val, ok := interpreter.Stack.Pop(); ok {
-                    if val % 2 > 0 {
-                        interpreter.Cc = interpreter.Cc.Toggle()
-                    }
-                }
-            case Pointer:
-                if val, ok := interpreter.Stack.Pop(); ok {
-                    interpreter.Dp = interpreter.Dp.Rotate(val)
-                }
-            case NumOut:
-                if val, ok := interpreter.Stack.Pop(); ok {
-                    fmt.Print(val)
-                }
-            case CharOut:
-                if val, ok := interpreter.Stack.Pop(); ok {
-                    fmt.Print(string(val))
-                }
-            case NumIn:
-                b := make([]byte, 1)
-                _, err := interpreter.Input.Read(b)
-                if err != nil {
-                    panic(err)
-                }
-                val, err := strconv.Atoi(string(b[0]))
-                if err != nil {
-                    panic(err)
-                }
-                interpreter.Stack.Push(int32(val))
-            case CharIn:
-                b := make([]byte, 1)
-                _, err := interpreter.Input.Read(b)
-                if err != nil {
-                    panic(err)
-                }
-                interpreter.Stack.Push(int32(b[0]))
-            case Roll:
-                if f, s, ok := interpreter.Stack.Pop2(); ok {
-                    interpreter.Stack.Roll(s, f)
-                }
-            case Exit:
-                fmt.Println()
-                os.Exit(0)
-            default:
-                panic(fmt.Sprintf("%s not supported", call.Op))
-        }
-
+    output = outputName(filename, output, "normalized")
+    f, err := os.Create(output)
+    if err != nil {
+        return err
     }
+    defer f.Close()
+    if err := piet.EncodePNG(f, pietImage, 1); err != nil {
+        return err
+    }
+    report.Write(os.Stdout)
+    fmt.Printf("wrote %s\n", output)
+    return nil
 }
 
-func CompileTmpl(stmt Stmt, f io.Writer) {
-    err := asmTemplate.Execute(f, stmt)
+// lint writes the issues piet.Lint finds in img to stdout and returns how many
+// there are.
+func lint(img image.Image, opts piet.LoadOptions, formatName string) (int, error) {
+    format, err := piet.ParseLintFormat(formatName)
+    if err != nil {
+        return 0, err
+    }
+    issues, err := piet.Lint(img, opts)
     if err != nil {
-        panic(err)
+        return 0, err
     }
+    return len(issues), piet.WriteLint(os.Stdout, issues, format)
 }
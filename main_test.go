@@ -0,0 +1,36 @@
+package main
+
+import (
+    "errors"
+    "testing"
+
+    "github.com/jasonhightower/go-piet/piet"
+    "github.com/jasonhightower/go-piet/piet/piettest"
+)
+
+func TestExamples(t *testing.T) {
+    piettest.Golden(t, "examples")
+}
+
+func TestExamplesDifferential(t *testing.T) {
+    piettest.Differential(t, "examples")
+}
+
+func TestRunExitCode(t *testing.T) {
+    cases := []struct {
+        name string
+        err error
+        strict bool
+        code int
+    }{
+        {"limit", piet.LimitError{Err: piet.ErrMaxSteps}, false, limitExitCode},
+        {"strict", piet.Error{Reason: "stack underflow"}, true, strictExitCode},
+        {"overflow", piet.Error{Reason: "stack overflow"}, false, failExitCode},
+        {"output", errors.New("write /dev/stdout: broken pipe"), true, failExitCode},
+    }
+    for _, c := range cases {
+        if code := runExitCode(c.err, c.strict); code != c.code {
+            t.Errorf("%s: expected exit code %d, got %d", c.name, c.code, code)
+        }
+    }
+}
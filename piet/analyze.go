@@ -0,0 +1,257 @@
+package piet
+
+import (
+    "fmt"
+    "image"
+    "math"
+    "sort"
+)
+
+// UnboundedDepth is the Max of a DepthRange with no upper bound.
+const UnboundedDepth = math.MaxInt
+
+// DepthRange is the range of stack depths a program can have at some point.
+type DepthRange struct {
+    Min, Max int
+}
+func (r DepthRange) String() string {
+    if r.Max == UnboundedDepth {
+        return fmt.Sprintf("[%d, unbounded)", r.Min)
+    }
+    return fmt.Sprintf("[%d, %d]", r.Min, r.Max)
+}
+func (r DepthRange) join(o DepthRange) DepthRange {
+    if o.Min < r.Min {
+        r.Min = o.Min
+    }
+    if o.Max > r.Max {
+        r.Max = o.Max
+    }
+    return r
+}
+
+// addDepth adds n to a depth, an unbounded depth stays unbounded.
+func addDepth(depth int, n int) int {
+    if depth == UnboundedDepth {
+        return depth
+    }
+    return depth + n
+}
+
+// needs is how many values op takes off the stack, the op is skipped when
+// there are fewer.
+func needs(op Op) int {
+    switch op {
+    case Pop, Not, Pointer, Switch, NumOut, CharOut, Dup:
+        return 1
+    case Add, Sub, Mult, Div, Mod, Greater, Roll:
+        return 2
+    default:
+        return 0
+    }
+}
+
+// after is the range of depths after op is performed on a stack with a depth
+// in r. pushed is how many values a push pushes.
+func (r DepthRange) after(op Op, pushed int) DepthRange {
+    // depths too shallow for the op are left alone
+    shrink := func(depth int, by int) int {
+        if depth < needs(op) {
+            return depth
+        }
+        return addDepth(depth, -by)
+    }
+    switch op {
+    case Push:
+        return DepthRange{r.Min + pushed, addDepth(r.Max, pushed)}
+    case Dup:
+        return DepthRange{shrink(r.Min, -1), shrink(r.Max, -1)}
+    case NumIn, CharIn:
+        // nothing is pushed at the end of the input
+        return DepthRange{r.Min, addDepth(r.Max, 1)}
+    case Pop, Pointer, Switch, NumOut, CharOut:
+        return DepthRange{shrink(r.Min, 1), shrink(r.Max, 1)}
+    case Add, Sub, Mult, Greater:
+        return DepthRange{shrink(r.Min, 1), shrink(r.Max, 1)}
+    case Div, Mod:
+        // dividing by zero leaves both operands
+        return DepthRange{shrink(r.Min, 1), r.Max}
+    case Roll:
+        // an ignored roll leaves both operands
+        return DepthRange{shrink(r.Min, 2), r.Max}
+    default:
+        return r
+    }
+}
+
+// BlockState is a color block entered with some DP and CC.
+type BlockState struct {
+    Block int
+    Dp Dp
+    Cc Cc
+}
+
+// StackWarning is something AnalyzeStack found. X and Y are a codel of the
+// block the op is performed from.
+type StackWarning struct {
+    X, Y int
+    Op Op
+    Dp Dp
+    Cc Cc
+    Reason string
+}
+func (w StackWarning) String() string {
+    return fmt.Sprintf("%s at (%d, %d) dp %s cc %s: %s", w.Op, w.X, w.Y, w.Dp, w.Cc, w.Reason)
+}
+
+// StackAnalysis is the result of AnalyzeStack.
+type StackAnalysis struct {
+    // Depths are the stack depths each reachable state can be entered with.
+    Depths map[BlockState]DepthRange
+    // MaxDepth is the most values the stack can hold, UnboundedDepth if
+    // there is no limit.
+    MaxDepth int
+    Warnings []StackWarning
+}
+
+// widenAfter is how many times the largest depth of a state may grow before
+// it is assumed to grow without bound.
+const widenAfter = 8
+
+// AnalyzeStack works out the range of stack depths for every block and DP/CC
+// state reachable from the start. Like Reachable it assumes pointer and switch
+// ops can produce any DP or CC. It warns about ops that can find too few
+// values on the stack and are skipped, and about loops that keep growing the
+// stack.
+func (p *Program) AnalyzeStack() StackAnalysis {
+    analysis := StackAnalysis{Depths: map[BlockState]DepthRange{}}
+    start := p.Start()
+    if start < 0 {
+        return analysis
+    }
+    grown := map[BlockState]int{}
+    unbounded := map[BlockState]bool{}
+    enter := func(state BlockState, r DepthRange) bool {
+        current, seen := analysis.Depths[state]
+        if !seen {
+            analysis.Depths[state] = r
+            return true
+        }
+        joined := current.join(r)
+        if joined == current {
+            return false
+        }
+        if joined.Max > current.Max {
+            if grown[state] += 1; grown[state] > widenAfter {
+                joined.Max = UnboundedDepth
+                unbounded[state] = true
+            }
+        }
+        analysis.Depths[state] = joined
+        return true
+    }
+
+    first := BlockState{start, DpRight, CcLeft}
+    enter(first, DepthRange{})
+    pending := []BlockState{first}
+    for len(pending) > 0 {
+        cur := pending[len(pending) - 1]
+        pending = pending[:len(pending) - 1]
+        edge, ok := p.GetEdge(cur.Block, cur.Dp, cur.Cc)
+        if !ok || edge.Op == Exit {
+            continue
+        }
+        r := analysis.Depths[cur].after(edge.Op, int(edge.Data))
+        for _, next := range successors(edge) {
+            if enter(next, r) {
+                pending = append(pending, next)
+            }
+        }
+    }
+
+    for state, r := range analysis.Depths {
+        if r.Max > analysis.MaxDepth {
+            analysis.MaxDepth = r.Max
+        }
+        edge, ok := p.GetEdge(state.Block, state.Dp, state.Cc)
+        if !ok || edge.Op == Exit {
+            continue
+        }
+        if after := r.after(edge.Op, int(edge.Data)); after.Max > analysis.MaxDepth {
+            analysis.MaxDepth = after.Max
+        }
+        at := p.blockCodel(state.Block)
+        warning := StackWarning{X: at.X, Y: at.Y, Op: edge.Op, Dp: state.Dp, Cc: state.Cc}
+        if n := needs(edge.Op); r.Min < n {
+            warning.Reason = fmt.Sprintf("may find fewer than %d values on the stack and be skipped", n)
+            analysis.Warnings = append(analysis.Warnings, warning)
+        }
+        if unbounded[state] {
+            warning.Reason = "the stack grows without bound in a loop"
+            analysis.Warnings = append(analysis.Warnings, warning)
+        }
+    }
+    sort.Slice(analysis.Warnings, func(i, j int) bool {
+        f, s := analysis.Warnings[i], analysis.Warnings[j]
+        if f.Y != s.Y {
+            return f.Y < s.Y
+        }
+        if f.X != s.X {
+            return f.X < s.X
+        }
+        if f.Dp != s.Dp {
+            return f.Dp < s.Dp
+        }
+        if f.Cc != s.Cc {
+            return f.Cc < s.Cc
+        }
+        return f.Reason < s.Reason
+    })
+    return analysis
+}
+
+// successors are the states the pointer can be in after following edge.
+func successors(edge Edge) []BlockState {
+    states := []BlockState{}
+    for rotation := int32(0); rotation < 4; rotation++ {
+        if rotation > 0 && edge.Op != Pointer {
+            break
+        }
+        dp := edge.MoveDp.Rotate(rotation)
+        states = append(states, BlockState{edge.Target, dp, edge.MoveCc})
+        if edge.Op == Switch {
+            states = append(states, BlockState{edge.Target, dp, edge.MoveCc.Toggle()})
+        }
+    }
+    return states
+}
+
+// blockCodel is the top codel in the leftmost column of a block.
+func (p *Program) blockCodel(idx int) image.Point {
+    left := p.Shape(idx).xEdges.MinNode()
+    return image.Point{X: left.Key, Y: left.Min}
+}
+
+// traceDepth is the most values the stack can hold while running stmt.
+func traceDepth(stmt Stmt) int {
+    r := DepthRange{}
+    most := 0
+    var walk func(stmt Stmt)
+    walk = func(stmt Stmt) {
+        if block, ok := stmt.(StmtBlock); ok {
+            for _, child := range block.Children {
+                walk(child)
+            }
+        } else if call, ok := stmt.(Call); ok {
+            if (call.Op == Pointer || call.Op == Switch) && len(call.Args) > 0 {
+                return
+            }
+            r = r.after(call.Op, len(call.Args))
+            if r.Max > most {
+                most = r.Max
+            }
+        }
+    }
+    walk(stmt)
+    return most
+}
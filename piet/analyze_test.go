@@ -0,0 +1,85 @@
+package piet
+
+import (
+    "context"
+    "strings"
+    "testing"
+)
+
+// loadImage loads a PietImage with a codel size of 1.
+func loadImage(t *testing.T, img *PietImage) *Program {
+    t.Helper()
+    prog, err := Load(img, 1)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return prog
+}
+
+func TestAnalyzeStackLinear(t *testing.T) {
+    analysis := loadImage(t, linearProgram(Push, Push, Add, NumOut)).AnalyzeStack()
+    if len(analysis.Warnings) != 0 {
+        t.Errorf("Expected no warnings got %v", analysis.Warnings)
+    }
+    if analysis.MaxDepth != 2 {
+        t.Errorf("Expected a max depth of 2 got %d", analysis.MaxDepth)
+    }
+    if r := analysis.Depths[BlockState{3, DpRight, CcLeft}]; r != (DepthRange{2, 2}) {
+        t.Errorf("Expected the add to find 2 values got %s", r)
+    }
+}
+
+func TestAnalyzeStackUnderflow(t *testing.T) {
+    analysis := loadImage(t, linearProgram(Push, Add, NumOut)).AnalyzeStack()
+    if len(analysis.Warnings) != 1 {
+        t.Fatalf("Expected a warning for add got %v", analysis.Warnings)
+    }
+    warning := analysis.Warnings[0]
+    if warning.Op != Add || warning.X != 1 || warning.Y != 0 || !strings.Contains(warning.Reason, "fewer than 2") {
+        t.Errorf("Expected add at (1, 0) to underflow got %s", warning)
+    }
+}
+
+func TestAnalyzeStackUnbounded(t *testing.T) {
+    // in(number) going right and mod, which may leave its operands, going
+    // back left
+    img := NewPietImage(2, 1)
+    img.Set(0, 0, LightRed)
+    img.Set(1, 0, LightRed.Next(NumIn))
+    prog := loadImage(t, img)
+    analysis := prog.AnalyzeStack()
+    if analysis.MaxDepth != UnboundedDepth {
+        t.Errorf("Expected an unbounded depth got %d", analysis.MaxDepth)
+    }
+    unbounded := false
+    for _, warning := range analysis.Warnings {
+        unbounded = unbounded || strings.Contains(warning.Reason, "without bound")
+    }
+    if !unbounded {
+        t.Errorf("Expected a warning about the loop got %v", analysis.Warnings)
+    }
+    if size := asmStackSize(prog, StmtBlock{}, 64); size != 64 {
+        t.Errorf("Expected the capacity to size the stack got %d", size)
+    }
+    if size := asmStackSize(prog, StmtBlock{}, 0); size != defaultAsmStackSize {
+        t.Errorf("Expected the default stack size got %d", size)
+    }
+}
+
+func TestAsmStackSize(t *testing.T) {
+    prog := loadImage(t, linearProgram(Push, Push, Push, Mult, Add))
+    stmt := ParseStmt(prog.Tokens(), 64)
+    if size := asmStackSize(prog, stmt, 1 << 20); size != 3 {
+        t.Errorf("Expected a stack of 3 values got %d", size)
+    }
+    if depth := traceDepth(stmt); depth != 3 {
+        t.Errorf("Expected the trace to need 3 values got %d", depth)
+    }
+    var asm strings.Builder
+    if err := Compile(context.Background(), prog, &asm, Options{Capacity: 1 << 20}); err != nil {
+        t.Fatal(err)
+    }
+    if !strings.Contains(asm.String(), "resd 3 + 1") {
+        t.Errorf("Expected the buffer to hold 3 values")
+    }
+}
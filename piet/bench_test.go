@@ -0,0 +1,110 @@
+package piet
+
+import (
+    "image"
+    "io"
+    "math/rand"
+    "os"
+    "strings"
+    "testing"
+)
+
+type benchImage struct {
+    name string
+    img image.Image
+    input string
+}
+
+// benchImages are a small and a medium example program and a huge generated
+// one, each as the codel image Tokenize is given.
+func benchImages(b *testing.B) []benchImage {
+    b.Helper()
+    images := []benchImage{}
+    for _, c := range []struct {
+        name string
+        filename string
+        codelSize int
+    }{
+        {"small", "../examples/Piet_Hello_World.gif", 11},
+        {"medium", "../examples/tetris.gif", 0},
+    } {
+        img, err := ReadImage(c.filename)
+        if err != nil {
+            b.Fatal(err)
+        }
+        codelSize := c.codelSize
+        if codelSize == 0 {
+            codelSize = DetectCodelSize(img)
+        }
+        input, err := os.ReadFile(strings.TrimSuffix(c.filename, ".gif") + ".in")
+        if err != nil && !os.IsNotExist(err) {
+            b.Fatal(err)
+        }
+        images = append(images, benchImage{c.name, NewCodelImage(img, codelSize), string(input)})
+    }
+    g, err := Generate(rand.New(rand.NewSource(1)), GenerateOptions{Ops: 1000, MaxPush: 64})
+    if err != nil {
+        b.Fatal(err)
+    }
+    return append(images, benchImage{"huge", g.Image, ""})
+}
+
+func BenchmarkTokenize(b *testing.B) {
+    for _, bi := range benchImages(b) {
+        b.Run(bi.name, func(b *testing.B) {
+            for i := 0; i < b.N; i++ {
+                Tokenize(bi.img)
+            }
+        })
+    }
+}
+
+func BenchmarkCarrotMove(b *testing.B) {
+    for _, bi := range benchImages(b) {
+        tokens := Tokenize(bi.img)
+        // a codel of every shape to start the moves from
+        starts := make([]image.Point, tokens.Size())
+        for x := tokens.Width() - 1; x >= 0; x-- {
+            for y := tokens.Height() - 1; y >= 0; y-- {
+                starts[tokens.data[x][y]] = image.Point{X: x, Y: y}
+            }
+        }
+        b.Run(bi.name, func(b *testing.B) {
+            for i := 0; i < b.N; i++ {
+                for _, start := range starts {
+                    for dp := DpRight; dp <= DpUp; dp++ {
+                        for cc := CcLeft; cc <= CcRight; cc++ {
+                            carrot := Carrot{X: start.X, Y: start.Y, tokens: tokens}
+                            carrot.Move(dp, cc)
+                        }
+                    }
+                }
+            }
+        })
+    }
+}
+
+func BenchmarkParseStmt(b *testing.B) {
+    for _, bi := range benchImages(b) {
+        tokens := Tokenize(bi.img)
+        b.Run(bi.name, func(b *testing.B) {
+            for i := 0; i < b.N; i++ {
+                ParseStmt(tokens, 1 << 16)
+            }
+        })
+    }
+}
+
+func BenchmarkInterpret(b *testing.B) {
+    for _, bi := range benchImages(b) {
+        stmt := ParseStmt(Tokenize(bi.img), 1 << 16)
+        b.Run(bi.name, func(b *testing.B) {
+            for i := 0; i < b.N; i++ {
+                interpreter := NewInterpreterWith(1 << 16, strings.NewReader(bi.input), io.Discard)
+                if _, err := interpreter.Interpret(stmt); err != nil {
+                    b.Fatal(err)
+                }
+            }
+        })
+    }
+}
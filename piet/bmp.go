@@ -0,0 +1,233 @@
+package piet
+
+import (
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "image"
+    "image/color"
+    "io"
+    "math/bits"
+)
+
+// Decoding for uncompressed Windows BMP files with 1, 4, 8, 16, 24 or 32 bits
+// per pixel. RLE compressed bitmaps are not supported.
+
+func init() {
+    image.RegisterFormat("bmp", "BM", decodeBMP, decodeBMPConfig)
+}
+
+const (
+    bmpRGB = 0
+    bmpBitFields = 3
+)
+
+type bmpHeader struct {
+    width int
+    height int
+    topDown bool
+    bpp int
+    compression uint32
+    masks [4]uint32
+    palette color.Palette
+    dataOffset int
+}
+
+func readBMPHeader(r io.Reader) (bmpHeader, int, error) {
+    header := bmpHeader{}
+    fileHeader := make([]byte, 18)
+    if _, err := io.ReadFull(r, fileHeader); err != nil {
+        return header, 0, err
+    }
+    if string(fileHeader[:2]) != "BM" {
+        return header, 0, errors.New("bmp: invalid format")
+    }
+    header.dataOffset = int(binary.LittleEndian.Uint32(fileHeader[10:14]))
+    infoSize := int(binary.LittleEndian.Uint32(fileHeader[14:18]))
+    if infoSize < 12 || infoSize > 1024 {
+        return header, 0, fmt.Errorf("bmp: unsupported header size %d", infoSize)
+    }
+    info := make([]byte, infoSize - 4)
+    if _, err := io.ReadFull(r, info); err != nil {
+        return header, 0, err
+    }
+    read := 18 + len(info)
+
+    paletteEntrySize := 4
+    if infoSize == 12 {
+        header.width = int(binary.LittleEndian.Uint16(info[0:2]))
+        header.height = int(binary.LittleEndian.Uint16(info[2:4]))
+        header.bpp = int(binary.LittleEndian.Uint16(info[6:8]))
+        paletteEntrySize = 3
+    } else {
+        if infoSize < 40 {
+            return header, 0, fmt.Errorf("bmp: unsupported header size %d", infoSize)
+        }
+        header.width = int(int32(binary.LittleEndian.Uint32(info[0:4])))
+        height := int(int32(binary.LittleEndian.Uint32(info[4:8])))
+        if height < 0 {
+            height = -height
+            header.topDown = true
+        }
+        header.height = height
+        header.bpp = int(binary.LittleEndian.Uint16(info[10:12]))
+        header.compression = binary.LittleEndian.Uint32(info[12:16])
+        if header.compression == bmpBitFields {
+            if infoSize >= 52 {
+                count := 3
+                if infoSize >= 56 {
+                    count = 4
+                }
+                for i := 0; i < count; i++ {
+                    header.masks[i] = binary.LittleEndian.Uint32(info[36 + i * 4:40 + i * 4])
+                }
+            } else {
+                masks := make([]byte, 12)
+                if _, err := io.ReadFull(r, masks); err != nil {
+                    return header, 0, err
+                }
+                read += len(masks)
+                for i := 0; i < 3; i++ {
+                    header.masks[i] = binary.LittleEndian.Uint32(masks[i * 4:i * 4 + 4])
+                }
+            }
+        } else if header.compression != bmpRGB {
+            return header, 0, fmt.Errorf("bmp: unsupported compression %d", header.compression)
+        }
+    }
+    if header.width < 0 {
+        return header, 0, errors.New("bmp: negative width")
+    }
+    if err := checkImageSize("bmp", header.width, header.height); err != nil {
+        return header, 0, err
+    }
+
+    switch header.bpp {
+    case 1, 4, 8:
+        count := 1 << header.bpp
+        if infoSize >= 40 {
+            if used := int(binary.LittleEndian.Uint32(info[28:32])); used > 0 && used < count {
+                count = used
+            }
+        }
+        entries := make([]byte, count * paletteEntrySize)
+        if _, err := io.ReadFull(r, entries); err != nil {
+            return header, 0, err
+        }
+        read += len(entries)
+        header.palette = make(color.Palette, count)
+        for i := 0; i < count; i++ {
+            entry := entries[i * paletteEntrySize:]
+            header.palette[i] = color.RGBA{R: entry[2], G: entry[1], B: entry[0], A: 0xFF}
+        }
+    case 16:
+        if header.compression == bmpRGB {
+            header.masks = [4]uint32{0x7C00, 0x03E0, 0x001F, 0}
+        }
+    case 24:
+        if header.compression != bmpRGB {
+            return header, 0, errors.New("bmp: bit fields are not supported at 24 bits per pixel")
+        }
+    case 32:
+        if header.compression == bmpRGB {
+            header.masks = [4]uint32{0x00FF0000, 0x0000FF00, 0x000000FF, 0}
+        }
+    default:
+        return header, 0, fmt.Errorf("bmp: unsupported bits per pixel %d", header.bpp)
+    }
+    return header, read, nil
+}
+
+func decodeBMPConfig(r io.Reader) (image.Config, error) {
+    header, _, err := readBMPHeader(r)
+    if err != nil {
+        return image.Config{}, err
+    }
+    var model color.Model = color.RGBAModel
+    if header.palette != nil {
+        model = header.palette
+    }
+    return image.Config{ColorModel: model, Width: header.width, Height: header.height}, nil
+}
+
+func decodeBMP(r io.Reader) (image.Image, error) {
+    header, read, err := readBMPHeader(r)
+    if err != nil {
+        return nil, err
+    }
+    if header.dataOffset < read {
+        return nil, errors.New("bmp: pixel data overlaps the header")
+    }
+    if _, err := io.CopyN(io.Discard, r, int64(header.dataOffset - read)); err != nil {
+        return nil, err
+    }
+
+    stride := (header.width * header.bpp + 31) / 32 * 4
+    data, err := readData(r, stride * header.height)
+    if err != nil {
+        return nil, err
+    }
+
+    rect := image.Rect(0, 0, header.width, header.height)
+    var img interface {
+        image.Image
+        Set(x, y int, c color.Color)
+    }
+    if header.palette != nil {
+        img = image.NewPaletted(rect, header.palette)
+    } else {
+        img = image.NewRGBA(rect)
+    }
+
+    for i := 0; i < header.height; i++ {
+        row := data[i * stride:(i + 1) * stride]
+        y := header.height - 1 - i
+        if header.topDown {
+            y = i
+        }
+        for x := 0; x < header.width; x++ {
+            c, err := header.pixel(row, x)
+            if err != nil {
+                return nil, err
+            }
+            img.Set(x, y, c)
+        }
+    }
+    return img, nil
+}
+
+func (h bmpHeader) pixel(row []byte, x int) (color.Color, error) {
+    switch h.bpp {
+    case 1, 4, 8:
+        perByte := 8 / h.bpp
+        shift := 8 - h.bpp * (x % perByte + 1)
+        idx := int(row[x / perByte] >> shift) & (1 << h.bpp - 1)
+        if idx >= len(h.palette) {
+            return nil, fmt.Errorf("bmp: palette index %d out of range", idx)
+        }
+        return h.palette[idx], nil
+    case 24:
+        p := row[x * 3:]
+        return color.RGBA{R: p[2], G: p[1], B: p[0], A: 0xFF}, nil
+    case 16:
+        return h.masked(uint32(binary.LittleEndian.Uint16(row[x * 2:]))), nil
+    default:
+        return h.masked(binary.LittleEndian.Uint32(row[x * 4:])), nil
+    }
+}
+
+func (h bmpHeader) masked(val uint32) color.Color {
+    channel := func(mask uint32) uint8 {
+        if mask == 0 {
+            return 0
+        }
+        max := uint64(1) << bits.OnesCount32(mask) - 1
+        v := uint64((val & mask) >> bits.TrailingZeros32(mask))
+        return uint8(v * 0xFF / max)
+    }
+    c := color.NRGBA{R: channel(h.masks[0]), G: channel(h.masks[1]), B: channel(h.masks[2]), A: 0xFF}
+    if h.masks[3] != 0 {
+        c.A = channel(h.masks[3])
+    }
+    return c
+}
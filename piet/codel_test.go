@@ -0,0 +1,136 @@
+package piet
+
+import (
+    "image"
+    "image/color"
+    "testing"
+)
+
+func TestDetectCodelSize(t *testing.T) {
+    tImg := NewTestImage(12, 6)
+    tImg.SetRect(image.Rect(0, 0, 12, 6), colToColor[LightRed])
+    tImg.SetRect(image.Rect(3, 0, 9, 3), colToColor[DarkBlue])
+    tImg.SetRect(image.Rect(9, 3, 12, 6), colToColor[Black])
+
+    if size := DetectCodelSize(tImg); size != 3 {
+        t.Errorf("Expected codel size 3, got %d", size)
+    }
+    if mismatches := CodelMismatches(tImg, 3); len(mismatches) != 0 {
+        t.Errorf("Expected no mismatched codels, got %v", mismatches)
+    }
+
+    tImg.Set(4, 1, colToColor[White])
+    if size := DetectCodelSize(tImg); size != 1 {
+        t.Errorf("Expected codel size 1 after adding a stray pixel, got %d", size)
+    }
+    mismatches := CodelMismatches(tImg, 3)
+    if len(mismatches) != 1 || mismatches[0] != (image.Point{X:3, Y:0}) {
+        t.Errorf("Expected a single mismatch at (3, 0), got %v", mismatches)
+    }
+}
+
+func TestDetectCodelSizeExample(t *testing.T) {
+    img, err := ReadImage("../examples/nhello-big.gif")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if size := DetectCodelSize(img); size != 4 {
+        t.Errorf("Expected codel size 4 for nhello-big.gif, got %d", size)
+    }
+}
+
+func TestParseCodelSize(t *testing.T) {
+    if size, err := ParseCodelSize("auto"); err != nil || size != 0 {
+        t.Errorf("Expected auto to parse as 0, got %d %v", size, err)
+    }
+    if size, err := ParseCodelSize("5"); err != nil || size != 5 {
+        t.Errorf("Expected 5, got %d %v", size, err)
+    }
+    for _, invalid := range []string{"0", "-2", "big"} {
+        if _, err := ParseCodelSize(invalid); err == nil {
+            t.Errorf("Expected an error for codel size %s", invalid)
+        }
+    }
+}
+
+func TestCodelSampling(t *testing.T) {
+    tImg := NewTestImage(6, 3)
+    tImg.SetRect(image.Rect(0, 0, 3, 3), colToColor[LightRed])
+    tImg.SetRect(image.Rect(3, 0, 6, 3), colToColor[DarkGreen])
+    tImg.Set(0, 0, colToColor[White])
+    tImg.Set(5, 2, colToColor[Black])
+
+    topLeft, err := NewSampledCodelImage(tImg, 3, SampleTopLeft)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if col := ColorToCol(topLeft.At(0, 0)); col != White {
+        t.Errorf("Expected top left sampling to read white, got %d", col)
+    }
+
+    majority, err := NewSampledCodelImage(tImg, 3, SampleMajority)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if col := ColorToCol(majority.At(0, 0)); col != LightRed {
+        t.Errorf("Expected majority sampling to read light red, got %d", col)
+    }
+    if col := ColorToCol(majority.At(1, 0)); col != DarkGreen {
+        t.Errorf("Expected majority sampling to read dark green, got %d", col)
+    }
+
+    _, err = NewSampledCodelImage(tImg, 3, SampleStrict)
+    mismatch, ok := err.(CodelMismatchError)
+    if !ok {
+        t.Fatalf("Expected a CodelMismatchError, got %v", err)
+    }
+    expected := []image.Point{{X:0, Y:0}, {X:3, Y:0}}
+    if len(mismatch.Codels) != len(expected) || mismatch.Codels[0] != expected[0] || mismatch.Codels[1] != expected[1] {
+        t.Errorf("Expected mismatches at %v, got %v", expected, mismatch.Codels)
+    }
+
+    if _, err := ParseCodelSampling("median"); err == nil {
+        t.Errorf("Expected an error for an unknown sampling")
+    }
+}
+
+type offsetImage struct {
+    TestImage
+    min image.Point
+}
+func (o offsetImage) Bounds() image.Rectangle {
+    return o.TestImage.Bounds().Add(o.min)
+}
+func (o offsetImage) At(x int, y int) color.Color {
+    return o.TestImage.At(x - o.min.X, y - o.min.Y)
+}
+
+func TestCodelImageBounds(t *testing.T) {
+    tImg := NewTestImage(7, 5)
+    tImg.SetRect(image.Rect(0, 0, 7, 5), colToColor[LightCyan])
+    tImg.SetRect(image.Rect(6, 0, 7, 5), colToColor[DarkBlue])
+    tImg.SetRect(image.Rect(0, 4, 6, 5), colToColor[MediumYellow])
+    img := offsetImage{TestImage: tImg, min: image.Point{X:10, Y:20}}
+
+    codelImg := NewCodelImage(img, 2)
+    if bounds := codelImg.Bounds(); bounds != image.Rect(0, 0, 4, 3) {
+        t.Errorf("Expected bounds of 4x3 codels, got %v", bounds)
+    }
+    if col := ColorToCol(codelImg.At(0, 0)); col != LightCyan {
+        t.Errorf("Expected the first codel to be light cyan, got %d", col)
+    }
+    if col := ColorToCol(codelImg.At(3, 0)); col != DarkBlue {
+        t.Errorf("Expected the partial codel on the right to be dark blue, got %d", col)
+    }
+    if col := ColorToCol(codelImg.At(0, 2)); col != MediumYellow {
+        t.Errorf("Expected the partial codel on the bottom to be medium yellow, got %d", col)
+    }
+
+    tokens := Tokenize(img)
+    if tokens.Width() != 7 || tokens.Height() != 5 {
+        t.Errorf("Expected 7x5 tokens for an offset image, got %dx%d", tokens.Width(), tokens.Height())
+    }
+    if shape := tokens.At(0, 0); shape == nil || shape.Color != LightCyan || shape.Size != 24 {
+        t.Errorf("Expected a light cyan shape of size 24 at (0, 0)")
+    }
+}
@@ -0,0 +1,109 @@
+package piet
+
+import (
+    "image/color"
+    "testing"
+)
+
+func TestColorRoundTrip(t *testing.T) {
+    for col := LightRed; col <= Black; col++ {
+        if got := ColorToCol(col.Color()); got != col {
+            t.Errorf("Expected %d to map back to itself, got %d", col, got)
+        }
+    }
+}
+
+func TestNearestCol(t *testing.T) {
+    cases := []struct {
+        c color.Color
+        expected Col
+    }{
+        {color.RGBA{A:high, R:0xF0, G:0x10, B:0x08}, MediumRed},
+        {color.RGBA{A:high, R:0xB8, G:0xC4, B:0xFA}, LightBlue},
+        {color.RGBA{A:high, R:0x10, G:0x10, B:0x10}, Black},
+        {color.RGBA{A:high, R:0xF8, G:0xF8, B:0xF8}, White},
+        {color.RGBA{A:high, R:0x08, G:0xBC, B:0xC8}, DarkCyan},
+    }
+    for _, c := range cases {
+        if got := NearestCol(c.c, false); got != c.expected {
+            t.Errorf("Expected nearest RGB color of %v to be %d, got %d", c.c, c.expected, got)
+        }
+        if got := NearestCol(c.c, true); got != c.expected {
+            t.Errorf("Expected nearest Lab color of %v to be %d, got %d", c.c, c.expected, got)
+        }
+    }
+}
+
+func TestUnknownColorPolicy(t *testing.T) {
+    gray := color.RGBA{A:high, R:0x80, G:0x80, B:0x80}
+    offRed := color.RGBA{A:high, R:0xF8}
+
+    tImg := NewTestImage(3, 2)
+    tImg.SetRect(tImg.Bounds(), colToColor[LightGreen])
+    tImg.Set(2, 0, offRed)
+    tImg.Set(1, 1, gray)
+
+    cases := map[string]Col {
+        "white": White,
+        "black": Black,
+        "nearest": MediumRed,
+        "nearest-lab": MediumRed,
+    }
+    for name, expected := range cases {
+        policy, err := ParseUnknownColorPolicy(name)
+        if err != nil {
+            t.Errorf("Unexpected error parsing %s: %s", name, err)
+            continue
+        }
+        img, err := NewPolicyImage(tImg, policy)
+        if err != nil {
+            t.Errorf("Unexpected error for policy %s: %s", name, err)
+            continue
+        }
+        if got := ColorToCol(img.At(2, 0)); got != expected {
+            t.Errorf("Policy %s mapped (2, 0) to %d expected %d", name, got, expected)
+        }
+        if got := ColorToCol(img.At(0, 0)); got != LightGreen {
+            t.Errorf("Policy %s changed a Piet color at (0, 0) to %d", name, got)
+        }
+        tokens := Tokenize(img)
+        for _, shape := range tokens.shapes {
+            if shape.Color == Unrecoganized {
+                t.Errorf("Policy %s left an unrecognized shape", name)
+            }
+        }
+    }
+
+    _, err := NewPolicyImage(tImg, UnknownError)
+    unknown, ok := err.(UnknownColorError)
+    if !ok {
+        t.Fatalf("Expected an UnknownColorError, got %v", err)
+    }
+    if unknown.X != 2 || unknown.Y != 0 {
+        t.Errorf("Expected first unknown color at (2, 0), got (%d, %d)", unknown.X, unknown.Y)
+    }
+
+    if _, err := ParseUnknownColorPolicy("purple"); err == nil {
+        t.Errorf("Expected an error for an unknown policy name")
+    }
+}
+
+func TestUnrecognizedToOp(t *testing.T) {
+    if op := Unrecoganized.ToOp(LightRed); op != Noop {
+        t.Errorf("Expected noop leaving an unrecognized color, got %s", op)
+    }
+    if op := LightRed.ToOp(Unrecoganized); op != Noop {
+        t.Errorf("Expected noop entering an unrecognized color, got %s", op)
+    }
+}
+
+func TestNextInvertsToOp(t *testing.T) {
+    for c := LightRed; c < White; c++ {
+        for op := Push; op <= CharOut; op++ {
+            next := c.Next(op)
+            if got := c.ToOp(next); got != op {
+                t.Errorf("Expected %s to %s to be %s got %s", c, next, op, got)
+            }
+        }
+    }
+}
@@ -0,0 +1,208 @@
+package piet
+
+import (
+    "bytes"
+    "context"
+    "errors"
+    "fmt"
+    "io"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "runtime"
+    "strings"
+)
+
+// Outcome is what a backend observed when running a program.
+type Outcome struct {
+    Output string
+    // Failed is true when the program stopped with an error or a non-zero
+    // exit status.
+    Failed bool
+}
+
+// Backend runs a program one way so the results of the different ways can be
+// compared, see Differential.
+type Backend interface {
+    Name() string
+    // Available returns why the backend can't run here, nil if it can.
+    Available() error
+    Run(ctx context.Context, prog *Program, input []byte, opts Options) (Outcome, error)
+}
+
+// InterpreterBackend runs programs with Run, it is the reference the other
+// backends are compared to.
+type InterpreterBackend struct{}
+
+func (InterpreterBackend) Name() string {
+    return "interpreter"
+}
+func (InterpreterBackend) Available() error {
+    return nil
+}
+func (InterpreterBackend) Run(ctx context.Context, prog *Program, input []byte, opts Options) (Outcome, error) {
+    var output strings.Builder
+    _, err := Run(ctx, prog, bytes.NewReader(input), &output, opts)
+    if _, limited := err.(LimitError); limited {
+        return Outcome{}, err
+    }
+    return Outcome{Output: output.String(), Failed: err != nil}, nil
+}
+
+// NasmBackend compiles programs with the macho64 template, assembles them
+// with Assemble and runs the executable. It needs macOS on x86_64 with nasm
+// and the Xcode command line tools.
+type NasmBackend struct{}
+
+func (NasmBackend) Name() string {
+    return "nasm-macho64"
+}
+func (NasmBackend) Available() error {
+    if runtime.GOOS != "darwin" || runtime.GOARCH != "amd64" {
+        return fmt.Errorf("needs darwin/amd64, running on %s/%s", runtime.GOOS, runtime.GOARCH)
+    }
+    for _, tool := range []string{"nasm", "ld", "xcode-select"} {
+        if _, err := exec.LookPath(tool); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+func (NasmBackend) Run(ctx context.Context, prog *Program, input []byte, opts Options) (Outcome, error) {
+    dir, err := os.MkdirTemp("", "piet")
+    if err != nil {
+        return Outcome{}, err
+    }
+    defer os.RemoveAll(dir)
+    asmFile := filepath.Join(dir, "program.asm")
+    f, err := os.Create(asmFile)
+    if err != nil {
+        return Outcome{}, err
+    }
+    err = Compile(ctx, prog, f, opts)
+    f.Close()
+    if err != nil {
+        return Outcome{}, err
+    }
+    executable := filepath.Join(dir, "program")
+    if err := Assemble(asmFile, executable); err != nil {
+        return Outcome{}, err
+    }
+
+    var output bytes.Buffer
+    cmd := exec.CommandContext(ctx, executable)
+    cmd.Stdin = bytes.NewReader(input)
+    cmd.Stdout = &output
+    err = cmd.Run()
+    if ctx.Err() != nil {
+        return Outcome{}, ctx.Err()
+    }
+    var exitErr *exec.ExitError
+    if err != nil && !errors.As(err, &exitErr) {
+        return Outcome{}, err
+    }
+    return Outcome{Output: output.String(), Failed: err != nil}, nil
+}
+
+// Backends are the compile targets Differential checks by default.
+func Backends() []Backend {
+    return []Backend{NasmBackend{}}
+}
+
+// BackendResult is how one backend did compared to the interpreter.
+type BackendResult struct {
+    Backend string
+    Outcome Outcome
+    // Skipped says why the backend wasn't run.
+    Skipped error
+    // Err is set when the backend couldn't run the program at all.
+    Err error
+}
+
+// DiffReport compares the interpreter's outcome to the other backends.
+type DiffReport struct {
+    Reference Outcome
+    Results []BackendResult
+}
+
+func (r DiffReport) agrees(result BackendResult) bool {
+    return result.Err == nil && result.Outcome == r.Reference
+}
+
+// Disagreements are the backends that ran and didn't match the interpreter.
+func (r DiffReport) Disagreements() []BackendResult {
+    disagreements := []BackendResult{}
+    for _, result := range r.Results {
+        if result.Skipped == nil && !r.agrees(result) {
+            disagreements = append(disagreements, result)
+        }
+    }
+    return disagreements
+}
+
+// Describe explains how a disagreeing backend differs from the interpreter.
+func (r DiffReport) Describe(result BackendResult) string {
+    if result.Err != nil {
+        return fmt.Sprintf("%s: %s", result.Backend, result.Err)
+    }
+    return fmt.Sprintf("%s: output %q failed %t, interpreter output %q failed %t",
+        result.Backend, result.Outcome.Output, result.Outcome.Failed, r.Reference.Output, r.Reference.Failed)
+}
+
+// Differential runs prog with the interpreter and every available backend on
+// the same input. It returns an error when the interpreter itself can't run
+// the program to the end.
+func Differential(ctx context.Context, prog *Program, input []byte, opts Options, backends ...Backend) (DiffReport, error) {
+    reference, err := InterpreterBackend{}.Run(ctx, prog, input, opts)
+    if err != nil {
+        return DiffReport{}, err
+    }
+    report := DiffReport{Reference: reference}
+    for _, backend := range backends {
+        result := BackendResult{Backend: backend.Name()}
+        if result.Skipped = backend.Available(); result.Skipped == nil {
+            result.Outcome, result.Err = backend.Run(ctx, prog, input, opts)
+        }
+        report.Results = append(report.Results, result)
+    }
+    return report, nil
+}
+
+// RunDifferential runs Differential for every golden case in dir with the
+// default backends and writes what each backend did to w. It returns the
+// number of disagreements.
+func RunDifferential(dir string, w io.Writer) (int, error) {
+    cases, err := FindGoldenCases(dir)
+    if err != nil {
+        return 0, err
+    }
+    disagreements := 0
+    for _, c := range cases {
+        prog, opts, input, err := c.Load()
+        if err != nil {
+            return disagreements, err
+        }
+        ctx, cancel := context.WithTimeout(context.Background(), GoldenTimeout)
+        report, err := Differential(ctx, prog, input, opts, Backends()...)
+        cancel()
+        if err != nil {
+            fmt.Fprintf(w, "FAIL %s: %s\n", c.Name, err)
+            disagreements += 1
+            continue
+        }
+        failing := report.Disagreements()
+        for _, result := range report.Results {
+            switch {
+            case result.Skipped != nil:
+                fmt.Fprintf(w, "SKIP %s %s: %s\n", c.Name, result.Backend, result.Skipped)
+            case !report.agrees(result):
+                fmt.Fprintf(w, "FAIL %s %s\n", c.Name, report.Describe(result))
+            default:
+                fmt.Fprintf(w, "PASS %s %s\n", c.Name, result.Backend)
+            }
+        }
+        disagreements += len(failing)
+    }
+    fmt.Fprintf(w, "%d disagreements\n", disagreements)
+    return disagreements, nil
+}
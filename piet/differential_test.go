@@ -0,0 +1,66 @@
+package piet
+
+import (
+    "context"
+    "errors"
+    "strings"
+    "testing"
+)
+
+// testBackend runs the interpreter and lets a test change what it saw.
+type testBackend struct {
+    name string
+    unavailable error
+    change func(Outcome) Outcome
+}
+
+func (b testBackend) Name() string {
+    return b.name
+}
+func (b testBackend) Available() error {
+    return b.unavailable
+}
+func (b testBackend) Run(ctx context.Context, prog *Program, input []byte, opts Options) (Outcome, error) {
+    outcome, err := InterpreterBackend{}.Run(ctx, prog, input, opts)
+    return b.change(outcome), err
+}
+
+func TestDifferential(t *testing.T) {
+    img, err := ReadImage("../examples/nhello-big.gif")
+    if err != nil {
+        t.Fatal(err)
+    }
+    prog, err := Load(img, 0)
+    if err != nil {
+        t.Fatal(err)
+    }
+    same := testBackend{name: "same", change: func(o Outcome) Outcome {
+        return o
+    }}
+    upper := testBackend{name: "upper", change: func(o Outcome) Outcome {
+        return Outcome{Output: strings.ToUpper(o.Output)}
+    }}
+    failing := testBackend{name: "failing", change: func(o Outcome) Outcome {
+        return Outcome{Output: o.Output, Failed: true}
+    }}
+    missing := testBackend{name: "missing", unavailable: errors.New("not installed")}
+
+    report, err := Differential(context.Background(), prog, nil, Options{Capacity: 512}, same, upper, failing, missing)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if report.Reference.Output != "hello world!\n\n" || report.Reference.Failed {
+        t.Errorf("Unexpected interpreter outcome %v", report.Reference)
+    }
+    disagreements := report.Disagreements()
+    if len(disagreements) != 2 || disagreements[0].Backend != "upper" || disagreements[1].Backend != "failing" {
+        t.Errorf("Expected upper and failing to disagree, got %v", disagreements)
+    }
+    if report.Results[3].Skipped == nil {
+        t.Errorf("Expected the unavailable backend to be skipped")
+    }
+    expected := `upper: output "HELLO WORLD!\n\n" failed false, interpreter output "hello world!\n\n" failed false`
+    if got := report.Describe(disagreements[0]); got != expected {
+        t.Errorf("Expected %s got %s", expected, got)
+    }
+}
@@ -0,0 +1,132 @@
+package piet
+
+import (
+    "fmt"
+    "image"
+    "image/color"
+    "image/gif"
+    "image/png"
+    "io"
+)
+
+// PietImage is a grid of Col, one entry per codel. It implements image.Image
+// with the Piet palette so it can be tokenized directly or written out with
+// EncodeImage.
+type PietImage struct {
+    cols [][]Col
+}
+func NewPietImage(width int, height int) *PietImage {
+    pietImage := PietImage{
+        cols: make([][]Col, width),
+    }
+    for x := 0; x < width; x++ {
+        pietImage.cols[x] = make([]Col, height)
+        for y := 0; y < height; y++ {
+            pietImage.cols[x][y] = White
+        }
+    }
+    return &pietImage
+}
+func PietImageFromTokens(tokens *PietTokens) *PietImage {
+    pietImage := NewPietImage(tokens.Width(), tokens.Height())
+    for x := 0; x < tokens.Width(); x++ {
+        for y := 0; y < tokens.Height(); y++ {
+            pietImage.cols[x][y] = tokens.At(x, y).Color
+        }
+    }
+    return pietImage
+}
+func PietImageFromImage(img image.Image) *PietImage {
+    bounds := img.Bounds()
+    pietImage := NewPietImage(bounds.Dx(), bounds.Dy())
+    for x := 0; x < bounds.Dx(); x++ {
+        for y := 0; y < bounds.Dy(); y++ {
+            pietImage.cols[x][y] = ColorToCol(img.At(bounds.Min.X + x, bounds.Min.Y + y))
+        }
+    }
+    return pietImage
+}
+func (p *PietImage) Width() int {
+    return len(p.cols)
+}
+func (p *PietImage) Height() int {
+    if len(p.cols) == 0 {
+        return 0
+    }
+    return len(p.cols[0])
+}
+func (p *PietImage) Col(x int, y int) Col {
+    return p.cols[x][y]
+}
+func (p *PietImage) Set(x int, y int, c Col) {
+    p.cols[x][y] = c
+}
+func (p *PietImage) SetRect(rect image.Rectangle, c Col) {
+    for x := rect.Min.X; x < rect.Max.X; x++ {
+        for y := rect.Min.Y; y < rect.Max.Y; y++ {
+            p.cols[x][y] = c
+        }
+    }
+}
+func (p *PietImage) At(x int, y int) color.Color {
+    if x < 0 || y < 0 || x >= p.Width() || y >= p.Height() {
+        return color.Transparent
+    }
+    return p.cols[x][y].Color()
+}
+func (p *PietImage) Bounds() image.Rectangle {
+    return image.Rect(0, 0, p.Width(), p.Height())
+}
+func (p *PietImage) ColorModel() color.Model {
+    return pietPalette
+}
+
+// Scale draws every codel as a codelSize square using the canonical palette.
+func (p *PietImage) Scale(codelSize int) (*image.Paletted, error) {
+    if codelSize < 1 {
+        return nil, fmt.Errorf("invalid codel size %d", codelSize)
+    }
+    scaled := image.NewPaletted(image.Rect(0, 0, p.Width() * codelSize, p.Height() * codelSize), pietPalette)
+    for x := 0; x < p.Width(); x++ {
+        for y := 0; y < p.Height(); y++ {
+            col := p.cols[x][y]
+            if col == Unrecoganized {
+                return nil, fmt.Errorf("cannot encode an unrecognized color at (%d, %d)", x, y)
+            }
+            for dy := 0; dy < codelSize; dy++ {
+                row := scaled.PixOffset(x * codelSize, y * codelSize + dy)
+                for dx := 0; dx < codelSize; dx++ {
+                    scaled.Pix[row + dx] = uint8(col)
+                }
+            }
+        }
+    }
+    return scaled, nil
+}
+
+func EncodePNG(w io.Writer, img *PietImage, codelSize int) error {
+    scaled, err := img.Scale(codelSize)
+    if err != nil {
+        return err
+    }
+    return png.Encode(w, scaled)
+}
+
+func EncodeGIF(w io.Writer, img *PietImage, codelSize int) error {
+    scaled, err := img.Scale(codelSize)
+    if err != nil {
+        return err
+    }
+    return gif.Encode(w, scaled, nil)
+}
+
+func EncodeImage(w io.Writer, img *PietImage, codelSize int, format string) error {
+    switch format {
+    case "png":
+        return EncodePNG(w, img, codelSize)
+    case "gif":
+        return EncodeGIF(w, img, codelSize)
+    default:
+        return fmt.Errorf("unsupported image format %s, expected one of (png, gif)", format)
+    }
+}
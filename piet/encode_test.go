@@ -0,0 +1,54 @@
+package piet
+
+import (
+    "bytes"
+    "image"
+    "testing"
+)
+
+func TestEncodeRoundTrip(t *testing.T) {
+    src, err := ReadImage("../examples/Piet_Hello_World.gif")
+    if err != nil {
+        t.Fatal(err)
+    }
+    expected := Tokenize(NewCodelImage(src, 11))
+    pietImage := PietImageFromTokens(expected)
+
+    for _, format := range []string{"png", "gif"} {
+        for _, codelSize := range []int{1, 3} {
+            var buf bytes.Buffer
+            if err := EncodeImage(&buf, pietImage, codelSize, format); err != nil {
+                t.Errorf("%s: %s", format, err)
+                continue
+            }
+            img, decodedFormat, err := image.Decode(&buf)
+            if err != nil {
+                t.Errorf("%s: %s", format, err)
+                continue
+            }
+            if decodedFormat != format {
+                t.Errorf("Expected %s, decoded %s", format, decodedFormat)
+            }
+            if img.Bounds().Dx() != pietImage.Width() * codelSize {
+                t.Errorf("%s: expected width %d, got %d", format, pietImage.Width() * codelSize, img.Bounds().Dx())
+            }
+            if size := DetectCodelSize(img); size != codelSize {
+                t.Errorf("%s: expected codel size %d, detected %d", format, codelSize, size)
+            }
+            tokensEqual(t, format, expected, Tokenize(NewCodelImage(img, codelSize)))
+        }
+    }
+    tokensEqual(t, "piet image", expected, Tokenize(pietImage))
+}
+
+func TestEncodeUnrecognized(t *testing.T) {
+    pietImage := NewPietImage(2, 2)
+    pietImage.Set(1, 1, Unrecoganized)
+    var buf bytes.Buffer
+    if err := EncodePNG(&buf, pietImage, 1); err == nil {
+        t.Errorf("Expected an error encoding an unrecognized color")
+    }
+    if err := EncodeImage(&buf, NewPietImage(1, 1), 1, "tiff"); err == nil {
+        t.Errorf("Expected an error for an unsupported format")
+    }
+}
@@ -0,0 +1,196 @@
+package piet
+
+import (
+    "bytes"
+    "encoding/binary"
+    "fmt"
+    "image"
+    "image/color"
+    "image/png"
+    "io"
+    "math"
+    "strings"
+    "testing"
+)
+
+func encodePPM(img image.Image, plain bool) []byte {
+    var buf bytes.Buffer
+    bounds := img.Bounds()
+    magic := "P6"
+    if plain {
+        magic = "P3"
+    }
+    fmt.Fprintf(&buf, "%s\n# written by go-piet tests\n%d %d\n255\n", magic, bounds.Dx(), bounds.Dy())
+    for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+        for x := bounds.Min.X; x < bounds.Max.X; x++ {
+            r, g, b, _ := img.At(x, y).RGBA()
+            if plain {
+                fmt.Fprintf(&buf, "%d %d %d\n", r >> 8, g >> 8, b >> 8)
+            } else {
+                buf.Write([]byte{byte(r >> 8), byte(g >> 8), byte(b >> 8)})
+            }
+        }
+    }
+    return buf.Bytes()
+}
+
+// encodeBMP writes a BITMAPINFOHEADER bitmap with either 8 bit palette
+// indexes or 24 bit pixels.
+func encodeBMP(img image.Image, paletted bool, topDown bool) []byte {
+    bounds := img.Bounds()
+    width, height := bounds.Dx(), bounds.Dy()
+    bpp := 24
+    var palette color.Palette
+    if paletted {
+        bpp = 8
+        palette = pietPalette
+    }
+    stride := (width * bpp + 31) / 32 * 4
+    offset := 14 + 40 + len(palette) * 4
+
+    var buf bytes.Buffer
+    le := func(v any) {
+        binary.Write(&buf, binary.LittleEndian, v)
+    }
+    buf.WriteString("BM")
+    le(uint32(offset + stride * height))
+    le(uint32(0))
+    le(uint32(offset))
+    le(uint32(40))
+    le(int32(width))
+    if topDown {
+        le(int32(-height))
+    } else {
+        le(int32(height))
+    }
+    le(uint16(1))
+    le(uint16(bpp))
+    le(uint32(0))
+    le(uint32(stride * height))
+    le(int32(2835))
+    le(int32(2835))
+    le(uint32(len(palette)))
+    le(uint32(0))
+    for _, c := range palette {
+        r, g, b, _ := c.RGBA()
+        buf.Write([]byte{byte(b >> 8), byte(g >> 8), byte(r >> 8), 0})
+    }
+    for i := 0; i < height; i++ {
+        y := bounds.Min.Y + height - 1 - i
+        if topDown {
+            y = bounds.Min.Y + i
+        }
+        row := make([]byte, stride)
+        for x := 0; x < width; x++ {
+            c := img.At(bounds.Min.X + x, y)
+            if paletted {
+                row[x] = byte(palette.Index(c))
+            } else {
+                r, g, b, _ := c.RGBA()
+                copy(row[x * 3:], []byte{byte(b >> 8), byte(g >> 8), byte(r >> 8)})
+            }
+        }
+        buf.Write(row)
+    }
+    return buf.Bytes()
+}
+
+func TestDecodeFormats(t *testing.T) {
+    for _, example := range []string{"../examples/Piet_Hello_World.gif", "../examples/nhello-big.gif", "../examples/tetris.gif"} {
+        src, err := ReadImage(example)
+        if err != nil {
+            t.Fatal(err)
+        }
+        var pngBuf bytes.Buffer
+        if err := png.Encode(&pngBuf, src); err != nil {
+            t.Fatal(err)
+        }
+        pngImg, _, err := image.Decode(&pngBuf)
+        if err != nil {
+            t.Fatal(err)
+        }
+        expected := Tokenize(pngImg)
+
+        encodings := map[string][]byte {
+            "P3": encodePPM(src, true),
+            "P6": encodePPM(src, false),
+            "bmp 24 bit": encodeBMP(src, false, false),
+            "bmp 24 bit top down": encodeBMP(src, false, true),
+            "bmp 8 bit": encodeBMP(src, true, false),
+        }
+        for name, data := range encodings {
+            img, format, err := image.Decode(bytes.NewReader(data))
+            if err != nil {
+                t.Errorf("%s %s: %s", example, name, err)
+                continue
+            }
+            if format != "ppm" && format != "bmp" {
+                t.Errorf("%s %s: decoded as %s", example, name, format)
+            }
+            tokensEqual(t, example + " " + name, expected, Tokenize(img))
+        }
+    }
+}
+
+func TestDecodePPM16Bit(t *testing.T) {
+    data := []byte("P3 2 1 65535\n65535 0 0  49344 49344 65535\n")
+    img, _, err := image.Decode(bytes.NewReader(data))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if col := ColorToCol(img.At(0, 0)); col != MediumRed {
+        t.Errorf("Expected medium red, got %d", col)
+    }
+    if col := ColorToCol(img.At(1, 0)); col != LightBlue {
+        t.Errorf("Expected light blue, got %d", col)
+    }
+}
+
+func TestDecodeTruncated(t *testing.T) {
+    if _, _, err := image.Decode(bytes.NewReader([]byte("P6 2 2 255\n\x00\x00"))); err == nil {
+        t.Errorf("Expected an error for a truncated ppm")
+    }
+    tImg := NewTestImage(2, 2)
+    tImg.SetRect(tImg.Bounds(), colToColor[White])
+    data := encodeBMP(tImg, false, false)
+    if _, _, err := image.Decode(bytes.NewReader(data[:len(data) - 3])); err == nil {
+        t.Errorf("Expected an error for a truncated bmp")
+    }
+}
+
+// resizedBMP is a small bitmap whose header claims width by height pixels.
+func resizedBMP(width int32, height int32) []byte {
+    tImg := NewTestImage(2, 2)
+    tImg.SetRect(tImg.Bounds(), colToColor[White])
+    data := encodeBMP(tImg, false, false)
+    binary.LittleEndian.PutUint32(data[18:22], uint32(width))
+    binary.LittleEndian.PutUint32(data[22:26], uint32(height))
+    return data
+}
+
+func TestDecodeOversized(t *testing.T) {
+    cases := map[string][]byte {
+        "bmp": resizedBMP(1 << 16, 1 << 16),
+        "bmp stride overflow": resizedBMP(math.MaxInt32, math.MaxInt32),
+        "P6": []byte("P6 100000 100000 255\n\x00\x00\x00"),
+        "P3": []byte("P3 65536 65536 255\n0 0 0"),
+    }
+    for name, data := range cases {
+        if _, _, err := image.Decode(bytes.NewReader(data)); err == nil || !strings.Contains(err.Error(), "too large") {
+            t.Errorf("%s: expected the image to be too large got %v", name, err)
+        }
+        if _, _, err := image.DecodeConfig(bytes.NewReader(data)); err == nil {
+            t.Errorf("%s: expected the config to be rejected", name)
+        }
+    }
+    // within the limit but without the data the header asks for
+    for name, data := range map[string][]byte {
+        "bmp": resizedBMP(4096, 4096),
+        "P6": []byte("P6 4096 4096 255\n\x00\x00\x00"),
+        "P3": []byte("P3 4096 4096 255\n0 0 0"),
+    } {
+        if _, _, err := image.Decode(bytes.NewReader(data)); err != io.ErrUnexpectedEOF {
+            t.Errorf("%s: expected an unexpected EOF got %v", name, err)
+        }
+    }
+}
@@ -0,0 +1,149 @@
+package piet
+
+import (
+    "bytes"
+    "context"
+    "image"
+    "io"
+    "math"
+    "strings"
+    "testing"
+)
+
+// maxFuzzSize keeps fuzzed images small enough to trace quickly.
+const maxFuzzSize = 24
+
+// fuzzImage builds an image of width by height codels with colors taken from
+// data, every one of the 21 Col values including Unrecoganized can appear.
+func fuzzImage(width uint8, height uint8, data []byte) *PietImage {
+    w := int(width) % maxFuzzSize + 1
+    h := int(height) % maxFuzzSize + 1
+    img := NewPietImage(w, h)
+    for i := 0; i < w * h && len(data) > 0; i++ {
+        img.Set(i % w, i / w, Col(data[i % len(data)] % byte(Unrecoganized + 1)))
+    }
+    return img
+}
+
+func addFuzzSeeds(f *testing.F) {
+    f.Add(uint8(0), uint8(0), []byte{})
+    f.Add(uint8(3), uint8(3), []byte{byte(White)})
+    f.Add(uint8(4), uint8(1), []byte{byte(LightRed), byte(LightYellow)})
+    f.Add(uint8(5), uint8(5), []byte{byte(Unrecoganized), byte(LightRed), byte(Black), byte(White)})
+    f.Add(uint8(23), uint8(23), []byte{byte(MediumGreen)})
+    img := linearProgram(Push, Push, Push, Push, Roll, Dup, Roll, CharOut)
+    data := []byte{}
+    for y := 0; y < img.Height(); y++ {
+        for x := 0; x < img.Width(); x++ {
+            data = append(data, byte(img.Col(x, y)))
+        }
+    }
+    f.Add(uint8(img.Width() - 1), uint8(img.Height() - 1), data)
+}
+
+func FuzzTokenize(f *testing.F) {
+    addFuzzSeeds(f)
+    f.Fuzz(func(t *testing.T, width uint8, height uint8, data []byte) {
+        img := fuzzImage(width, height, data)
+        tokens := Tokenize(img)
+        if tokens.Width() != img.Width() || tokens.Height() != img.Height() {
+            t.Fatalf("Expected %dx%d tokens got %dx%d", img.Width(), img.Height(), tokens.Width(), tokens.Height())
+        }
+        for x := 0; x < img.Width(); x++ {
+            for y := 0; y < img.Height(); y++ {
+                shape := tokens.At(x, y)
+                if shape == nil {
+                    t.Fatalf("Expected (%d, %d) to belong to a shape", x, y)
+                }
+                if shape.Color != img.Col(x, y) {
+                    t.Fatalf("Expected (%d, %d) to be in a %s shape got %s", x, y, img.Col(x, y), shape.Color)
+                }
+            }
+        }
+        area := int32(0)
+        for _, shape := range tokens.shapes {
+            area += shape.Size
+        }
+        if int(area) != img.Width() * img.Height() {
+            t.Errorf("Expected shape sizes to sum to %d got %d", img.Width() * img.Height(), area)
+        }
+    })
+}
+
+func FuzzParse(f *testing.F) {
+    addFuzzSeeds(f)
+    f.Fuzz(func(t *testing.T, width uint8, height uint8, data []byte) {
+        tokens := Tokenize(fuzzImage(width, height, data))
+        prog := Parse(tokens)
+        prog.Reachable()
+        ParseStmtWith(tokens, ParseOptions{Capacity: 64, MaxCalls: 1000})
+        ParseStmtWith(tokens, ParseOptions{Capacity: 64, MaxCalls: 1000, Strict: true})
+    })
+}
+
+func FuzzInterpret(f *testing.F) {
+    f.Add(uint8(4), uint8(1), []byte{byte(LightRed), byte(LightYellow)}, "", false)
+    f.Add(uint8(5), uint8(5), []byte{byte(Unrecoganized), byte(LightRed), byte(Black)}, "-12 x", true)
+    f.Add(uint8(7), uint8(2), []byte{byte(LightRed), byte(DarkRed), byte(MediumBlue), byte(LightGreen)}, "2147483648 é", false)
+    f.Fuzz(func(t *testing.T, width uint8, height uint8, data []byte, input string, strict bool) {
+        prog := Parse(Tokenize(fuzzImage(width, height, data)))
+        for _, encoding := range []Encoding{EncodingUTF8, EncodingBytes} {
+            opts := Options{Capacity: 64, Strict: strict, Encoding: encoding, MaxSteps: 1000}
+            Run(context.Background(), prog, strings.NewReader(input), io.Discard, opts)
+        }
+    })
+}
+
+func FuzzDecode(f *testing.F) {
+    tImg := NewTestImage(3, 2)
+    tImg.SetRect(tImg.Bounds(), colToColor[LightRed])
+    f.Add(encodeBMP(tImg, true, false))
+    f.Add(encodePPM(tImg, true))
+    f.Add(encodePPM(tImg, false))
+    f.Add(resizedBMP(1 << 16, 1 << 16))
+    f.Add(resizedBMP(math.MaxInt32, -math.MaxInt32))
+    f.Add(resizedBMP(4096, 4096))
+    f.Add([]byte("P6 100000 100000 255\n\x00"))
+    f.Add([]byte("P3 4096 4096 65535\n0 0 0"))
+    f.Fuzz(func(t *testing.T, data []byte) {
+        img, _, err := image.Decode(bytes.NewReader(data))
+        if err != nil {
+            return
+        }
+        if bounds := img.Bounds(); bounds.Dx() * bounds.Dy() > maxImagePixels {
+            t.Errorf("Expected at most %d pixels got %dx%d", maxImagePixels, bounds.Dx(), bounds.Dy())
+        }
+    })
+}
+
+func FuzzRoll(f *testing.F) {
+    f.Add(3, int32(2), int32(1))
+    f.Add(0, int32(0), int32(-1))
+    f.Add(4, int32(-1), int32(2147483647))
+    f.Add(5, int32(5), int32(-2147483648))
+    f.Fuzz(func(t *testing.T, size int, depth int32, rolls int32) {
+        size = (size % 15 + 15) % 15
+        values := []int32{}
+        s := NewStack(16)
+        for i := 0; i < size; i++ {
+            values = append(values, int32(i + 1))
+            s.Push(int32(i + 1))
+        }
+        if !s.Roll(depth, rolls) {
+            s.Push(depth)
+            s.Push(rolls)
+        }
+        reduced := rolls
+        if depth > 0 && int(depth) <= size {
+            // naiveRoll adds depth until rolls is positive, keep that short.
+            reduced = rolls % depth
+        }
+        expected := NewStack(18)
+        for _, v := range naiveRoll(values, depth, reduced) {
+            expected.Push(v)
+        }
+        if s.String() != expected.String() {
+            t.Errorf("Roll %v depth %d rolls %d: expected %s got %s", values, depth, rolls, expected, s)
+        }
+    })
+}
@@ -0,0 +1,218 @@
+package piet
+
+import (
+    "fmt"
+    "io"
+    "math/rand"
+    "sort"
+)
+
+// GenerateOptions control the programs Generate builds.
+type GenerateOptions struct {
+    // Ops is how many ops the program performs before it stops.
+    Ops int
+    // MaxPush is the largest value a single push can push, it sets the height
+    // of the image. 0 uses defaultMaxPush.
+    MaxPush int
+    // Weights are how often each op is picked relative to the others, ops
+    // that are left out are never picked. nil picks every op in
+    // GeneratedOps equally often.
+    Weights map[Op]int
+    // CodelSize is the size of a codel when the image is encoded, 0 means 1.
+    CodelSize int
+}
+
+// defaultMaxPush is the largest value a push pushes unless MaxPush is set.
+const defaultMaxPush = 8
+
+// GeneratedOps are the ops Generate can use. The pointer and switch ops are
+// left out so the program never turns, and the input ops so that its output
+// only depends on the image.
+var GeneratedOps = []Op{Push, Pop, Add, Sub, Mult, Div, Mod, Not, Greater, Dup, Roll, NumOut, CharOut}
+
+// GeneratedProgram is a random program along with what it is expected to do.
+type GeneratedProgram struct {
+    Image *PietImage
+    CodelSize int
+    // Ops are the ops the program performs in order.
+    Ops []Op
+    // Output is what running the program writes with EncodingUTF8, including
+    // the newline written when it exits.
+    Output string
+}
+
+// Encode writes the image in format (png | gif) scaled to the codel size.
+func (g *GeneratedProgram) Encode(w io.Writer, format string) error {
+    return EncodeImage(w, g.Image, g.CodelSize, format)
+}
+
+// Generate builds a random program that performs opts.Ops ops and then stops.
+//
+// Every color block is a column hanging from the top row, the pointer moves
+// right along the top row from one block to the next. A block is only taller
+// than one codel when the next op pushes its size. The last column and the
+// codel left of it on the bottom row form a block the pointer can't leave, so
+// the program always terminates.
+func Generate(r *rand.Rand, opts GenerateOptions) (*GeneratedProgram, error) {
+    if opts.Ops < 0 {
+        return nil, fmt.Errorf("can't generate %d ops", opts.Ops)
+    }
+    maxPush := opts.MaxPush
+    if maxPush == 0 {
+        maxPush = defaultMaxPush
+    }
+    if maxPush < 1 {
+        return nil, fmt.Errorf("can't push at most %d", maxPush)
+    }
+    codelSize := opts.CodelSize
+    if codelSize == 0 {
+        codelSize = 1
+    }
+    pick, err := opPicker(opts.Weights)
+    if err != nil {
+        return nil, err
+    }
+
+    ops := make([]Op, opts.Ops)
+    for i := range ops {
+        ops[i] = pick(r)
+    }
+    // heights[i] is the height of the block left to perform ops[i]
+    heights := make([]int, opts.Ops + 1)
+    for i := range heights {
+        heights[i] = 1
+        if i < len(ops) && ops[i] == Push {
+            heights[i] = r.Intn(maxPush) + 1
+        }
+    }
+
+    width := len(ops) + 2
+    img := NewPietImage(width, maxPush + 1)
+    img.SetRect(img.Bounds(), Black)
+    col := Col(r.Intn(int(White)))
+    for i, height := range heights {
+        if i > 0 {
+            col = col.Next(ops[i - 1])
+        }
+        for y := 0; y < height; y++ {
+            img.Set(i, y, col)
+        }
+    }
+    trap := col.Next(Push)
+    for y := 0; y <= maxPush; y++ {
+        img.Set(width - 1, y, trap)
+    }
+    img.Set(width - 2, maxPush, trap)
+
+    return &GeneratedProgram{
+        Image: img,
+        CodelSize: codelSize,
+        Ops: ops,
+        Output: expectedOutput(ops, heights),
+    }, nil
+}
+
+// opPicker returns a function that picks ops with the given weights.
+func opPicker(weights map[Op]int) (func(*rand.Rand) Op, error) {
+    if weights == nil {
+        return func(r *rand.Rand) Op {
+            return GeneratedOps[r.Intn(len(GeneratedOps))]
+        }, nil
+    }
+    ops := []Op{}
+    total := 0
+    for op, weight := range weights {
+        generated := false
+        for _, g := range GeneratedOps {
+            generated = generated || g == op
+        }
+        if !generated {
+            return nil, fmt.Errorf("can't generate %s ops", op)
+        }
+        if weight < 0 {
+            return nil, fmt.Errorf("negative weight %d for %s", weight, op)
+        }
+        if weight > 0 {
+            ops = append(ops, op)
+            total += weight
+        }
+    }
+    if total == 0 {
+        return nil, fmt.Errorf("no op has a positive weight")
+    }
+    // map order is random, sort so a seed always gives the same program
+    sort.Slice(ops, func(i, j int) bool {
+        return ops[i] < ops[j]
+    })
+    return func(r *rand.Rand) Op {
+        n := r.Intn(total)
+        for _, op := range ops {
+            if n < weights[op] {
+                return op
+            }
+            n -= weights[op]
+        }
+        return ops[len(ops) - 1]
+    }, nil
+}
+
+// expectedOutput works out what the ops write, heights[i] is the value pushed
+// when ops[i] is a push.
+func expectedOutput(ops []Op, heights []int) string {
+    stack := NewStack(0)
+    output := ""
+    for i, op := range ops {
+        switch op {
+        case Push:
+            stack.Push(int32(heights[i]))
+        case Pop:
+            stack.Pop()
+        case Add, Sub, Mult, Div, Mod, Greater:
+            f, s, ok := stack.Pop2()
+            if !ok {
+                break
+            }
+            switch {
+            case op == Add:
+                stack.Push(s + f)
+            case op == Sub:
+                stack.Push(s - f)
+            case op == Mult:
+                stack.Push(s * f)
+            case op == Greater && s > f:
+                stack.Push(1)
+            case op == Greater:
+                stack.Push(0)
+            case f == 0:
+                stack.Push(s)
+                stack.Push(f)
+            case op == Div:
+                stack.Push(FloorDiv(s, f))
+            default:
+                stack.Push(FloorMod(s, f))
+            }
+        case Not:
+            if val, ok := stack.Pop(); ok && val == 0 {
+                stack.Push(1)
+            } else if ok {
+                stack.Push(0)
+            }
+        case Dup:
+            stack.Dup()
+        case Roll:
+            if f, s, ok := stack.Pop2(); ok && !stack.Roll(s, f) {
+                stack.Push(s)
+                stack.Push(f)
+            }
+        case NumOut:
+            if val, ok := stack.Pop(); ok {
+                output += fmt.Sprint(val)
+            }
+        case CharOut:
+            if val, ok := stack.Pop(); ok {
+                output += string(rune(val))
+            }
+        }
+    }
+    return output + "\n"
+}
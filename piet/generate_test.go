@@ -0,0 +1,88 @@
+package piet
+
+import (
+    "bytes"
+    "context"
+    "image"
+    "math/rand"
+    "strings"
+    "testing"
+)
+
+func TestGenerateOutput(t *testing.T) {
+    r := rand.New(rand.NewSource(1))
+    for i := 0; i < 200; i++ {
+        g, err := Generate(r, GenerateOptions{Ops: r.Intn(40), MaxPush: r.Intn(6) + 1})
+        if err != nil {
+            t.Fatal(err)
+        }
+        prog, err := Load(g.Image, 1)
+        if err != nil {
+            t.Fatal(err)
+        }
+        var output strings.Builder
+        result, err := Run(context.Background(), prog, strings.NewReader(""), &output, Options{MaxSteps: 1000})
+        if err != nil || !result.Exited {
+            t.Fatalf("%v: expected the program to exit, got %v %v", g.Ops, result, err)
+        }
+        if output.String() != g.Output {
+            t.Errorf("%v: expected output %q got %q", g.Ops, g.Output, output.String())
+        }
+    }
+}
+
+func TestGenerateEncode(t *testing.T) {
+    g, err := Generate(rand.New(rand.NewSource(2)), GenerateOptions{Ops: 20, CodelSize: 3})
+    if err != nil {
+        t.Fatal(err)
+    }
+    var buf bytes.Buffer
+    if err := g.Encode(&buf, "png"); err != nil {
+        t.Fatal(err)
+    }
+    img, _, err := image.Decode(&buf)
+    if err != nil {
+        t.Fatal(err)
+    }
+    prog, err := Load(img, 0)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if prog.CodelSize() != 3 {
+        t.Errorf("Expected a codel size of 3 got %d", prog.CodelSize())
+    }
+    var output strings.Builder
+    if _, err := Run(context.Background(), prog, strings.NewReader(""), &output, Options{MaxSteps: 1000}); err != nil {
+        t.Fatal(err)
+    }
+    if output.String() != g.Output {
+        t.Errorf("Expected output %q got %q", g.Output, output.String())
+    }
+}
+
+func TestGenerateWeights(t *testing.T) {
+    g, err := Generate(rand.New(rand.NewSource(3)), GenerateOptions{Ops: 50, Weights: map[Op]int{Push: 3, NumOut: 1, Add: 0}})
+    if err != nil {
+        t.Fatal(err)
+    }
+    for _, op := range g.Ops {
+        if op != Push && op != NumOut {
+            t.Errorf("Expected only push and out(number) got %s", op)
+        }
+    }
+
+    for _, weights := range []map[Op]int{{Pointer: 1}, {NumIn: 1}, {Push: 0}, {Push: -1}} {
+        if _, err := Generate(rand.New(rand.NewSource(3)), GenerateOptions{Ops: 5, Weights: weights}); err == nil {
+            t.Errorf("Expected an error for weights %v", weights)
+        }
+    }
+}
+
+func TestGenerateSeed(t *testing.T) {
+    opts := GenerateOptions{Ops: 30, Weights: map[Op]int{Push: 2, Dup: 1, Mult: 1, NumOut: 1}}
+    f, _ := Generate(rand.New(rand.NewSource(4)), opts)
+    s, _ := Generate(rand.New(rand.NewSource(4)), opts)
+    if f.Output != s.Output || len(f.Ops) != len(s.Ops) {
+        t.Errorf("Expected the same seed to generate the same program")
+    }
+}
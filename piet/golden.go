@@ -0,0 +1,217 @@
+package piet
+
+import (
+    "bytes"
+    "context"
+    "flag"
+    "fmt"
+    "io"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+    "time"
+)
+
+// GoldenCase is a program with the input it reads and the output it is
+// expected to write, kept beside it as <name>.in and <name>.out. An optional
+// <name>.args holds the flags it is run with, like -codel-size 11.
+type GoldenCase struct {
+    Name string
+    Program string
+    Input string
+    Output string
+    Args []string
+}
+
+// GoldenTimeout stops a golden program that doesn't finish, on every backend.
+const GoldenTimeout = 10 * time.Second
+
+// goldenExtensions are the image files ReadImage decodes.
+var goldenExtensions = map[string]bool{
+    ".gif": true,
+    ".png": true,
+    ".jpg": true,
+    ".jpeg": true,
+    ".ppm": true,
+    ".bmp": true,
+}
+
+// FindGoldenCases finds every image ReadImage decodes in dir that has a .out
+// file.
+func FindGoldenCases(dir string) ([]GoldenCase, error) {
+    entries, err := os.ReadDir(dir)
+    if err != nil {
+        return nil, err
+    }
+    cases := []GoldenCase{}
+    for _, entry := range entries {
+        ext := filepath.Ext(entry.Name())
+        if entry.IsDir() || !goldenExtensions[strings.ToLower(ext)] {
+            continue
+        }
+        base := strings.TrimSuffix(filepath.Join(dir, entry.Name()), ext)
+        if _, err := os.Stat(base + ".out"); err != nil {
+            continue
+        }
+        c := GoldenCase{
+            Name: entry.Name(),
+            Program: filepath.Join(dir, entry.Name()),
+            Input: base + ".in",
+            Output: base + ".out",
+        }
+        if args, err := os.ReadFile(base + ".args"); err == nil {
+            c.Args = strings.Fields(string(args))
+        } else if !os.IsNotExist(err) {
+            return nil, err
+        }
+        cases = append(cases, c)
+    }
+    sort.Slice(cases, func(i, j int) bool {
+        return cases[i].Name < cases[j].Name
+    })
+    return cases, nil
+}
+
+// GoldenResult is the outcome of running a GoldenCase.
+type GoldenResult struct {
+    Case GoldenCase
+    Expected string
+    Output string
+    // Err is set when the program couldn't be loaded or stopped with an
+    // error.
+    Err error
+}
+func (r GoldenResult) Passed() bool {
+    return r.Err == nil && r.Output == r.Expected
+}
+
+// Diff shows the lines where the output differs from the expected output.
+func (r GoldenResult) Diff() string {
+    expected := strings.SplitAfter(r.Expected, "\n")
+    output := strings.SplitAfter(r.Output, "\n")
+    var diff strings.Builder
+    for i := 0; i < len(expected) || i < len(output); i++ {
+        var e, o string
+        if i < len(expected) {
+            e = expected[i]
+        }
+        if i < len(output) {
+            o = output[i]
+        }
+        if e == o {
+            continue
+        }
+        if e != "" {
+            fmt.Fprintf(&diff, "line %d\n-%q\n", i + 1, e)
+        }
+        if o != "" {
+            if e == "" {
+                fmt.Fprintf(&diff, "line %d\n", i + 1)
+            }
+            fmt.Fprintf(&diff, "+%q\n", o)
+        }
+    }
+    return diff.String()
+}
+
+// Load reads the program with the flags from its .args file and its input.
+func (c GoldenCase) Load() (*Program, Options, []byte, error) {
+    input, err := os.ReadFile(c.Input)
+    if err != nil && !os.IsNotExist(err) {
+        return nil, Options{}, nil, err
+    }
+    loadOpts, opts, err := parseGoldenArgs(c.Args)
+    if err != nil {
+        return nil, opts, nil, err
+    }
+    img, err := ReadImage(c.Program)
+    if err != nil {
+        return nil, opts, nil, err
+    }
+    prog, err := LoadWith(img, loadOpts)
+    return prog, opts, input, err
+}
+
+// Run runs the program through the interpreter with its input.
+func (c GoldenCase) Run() GoldenResult {
+    result := GoldenResult{Case: c}
+    expected, err := os.ReadFile(c.Output)
+    if err != nil {
+        result.Err = err
+        return result
+    }
+    result.Expected = string(expected)
+    prog, opts, input, err := c.Load()
+    if err != nil {
+        result.Err = err
+        return result
+    }
+    ctx, cancel := context.WithTimeout(context.Background(), GoldenTimeout)
+    defer cancel()
+    var output strings.Builder
+    _, result.Err = Run(ctx, prog, bytes.NewReader(input), &output, opts)
+    result.Output = output.String()
+    return result
+}
+
+// parseGoldenArgs reads the flags of the command line tool that change how a
+// program runs.
+func parseGoldenArgs(args []string) (LoadOptions, Options, error) {
+    flags := flag.NewFlagSet("golden", flag.ContinueOnError)
+    flags.SetOutput(io.Discard)
+    codelSize := flags.String("codel-size", "auto", "")
+    sampling := flags.String("codel-sampling", "topleft", "")
+    unknownColor := flags.String("unknown-color", "white", "")
+    encoding := flags.String("encoding", "utf8", "")
+    capacity := flags.Int("capacity", 1 << 20, "")
+    maxSteps := flags.Int("max-steps", 0, "")
+    strict := flags.Bool("strict", false, "")
+    optimize := flags.Int("O", 0, "")
+    if err := flags.Parse(args); err != nil {
+        return LoadOptions{}, Options{}, err
+    }
+
+    loadOpts := LoadOptions{}
+    opts := Options{Capacity: *capacity, MaxSteps: *maxSteps, Strict: *strict, Optimize: *optimize}
+    var err error
+    if loadOpts.CodelSize, err = ParseCodelSize(*codelSize); err != nil {
+        return loadOpts, opts, err
+    }
+    if loadOpts.Sampling, err = ParseCodelSampling(*sampling); err != nil {
+        return loadOpts, opts, err
+    }
+    if loadOpts.UnknownColor, err = ParseUnknownColorPolicy(*unknownColor); err != nil {
+        return loadOpts, opts, err
+    }
+    if opts.Encoding, err = ParseEncoding(*encoding); err != nil {
+        return loadOpts, opts, err
+    }
+    return loadOpts, opts, nil
+}
+
+// RunGolden runs every case found in dir and writes a line per case, the
+// diffs of the failing ones and a summary to w. It returns the number of
+// cases that failed.
+func RunGolden(dir string, w io.Writer) (int, error) {
+    cases, err := FindGoldenCases(dir)
+    if err != nil {
+        return 0, err
+    }
+    failed := 0
+    for _, c := range cases {
+        result := c.Run()
+        if result.Passed() {
+            fmt.Fprintf(w, "PASS %s\n", c.Name)
+            continue
+        }
+        failed += 1
+        fmt.Fprintf(w, "FAIL %s\n", c.Name)
+        if result.Err != nil {
+            fmt.Fprintf(w, "%s\n", result.Err)
+        }
+        io.WriteString(w, result.Diff())
+    }
+    fmt.Fprintf(w, "%d passed, %d failed\n", len(cases) - failed, failed)
+    return failed, nil
+}
@@ -0,0 +1,56 @@
+package piet
+
+import (
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+)
+
+func TestRunGolden(t *testing.T) {
+    dir := t.TempDir()
+    program, err := os.ReadFile("../examples/nhello-big.gif")
+    if err != nil {
+        t.Fatal(err)
+    }
+    ppm := "P3 1 1 255 255 0 0"
+    files := map[string]string{
+        "pass.gif": string(program),
+        "ppm.ppm": ppm,
+        "ppm.out": "\n",
+        "pass.out": "hello world!\n\n",
+        "fail.gif": string(program),
+        "fail.in": "",
+        "fail.out": "hello there!\n\n",
+        "args.gif": string(program),
+        "args.out": "hello world!\n\n",
+        "args.args": "-encoding latin1",
+        "missing.gif": string(program),
+    }
+    for name, content := range files {
+        if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    var output strings.Builder
+    failed, err := RunGolden(dir, &output)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if failed != 2 {
+        t.Errorf("Expected the fail and args cases to fail, got %d failures\n%s", failed, output.String())
+    }
+    expected := "FAIL args.gif\n" +
+        "unrecognized encoding latin1, expected one of (bytes, utf8)\n" +
+        "line 1\n-\"hello world!\\n\"\n" +
+        "line 2\n-\"\\n\"\n" +
+        "FAIL fail.gif\n" +
+        "line 1\n-\"hello there!\\n\"\n+\"hello world!\\n\"\n" +
+        "PASS pass.gif\n" +
+        "PASS ppm.ppm\n" +
+        "2 passed, 2 failed\n"
+    if output.String() != expected {
+        t.Errorf("Expected\n%s\ngot\n%s", expected, output.String())
+    }
+}
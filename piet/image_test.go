@@ -1,9 +1,13 @@
-package main
+package piet
 
 import (
+    "bytes"
     "testing"
     "image"
     "image/color"
+    "image/draw"
+    "image/gif"
+    "image/png"
 )
 
 var colToColor = map[Col]color.Color {
@@ -115,3 +119,84 @@ func TestTokenize(t *testing.T) {
 
     // verify all shapes are defined correctly
 }
+
+func tokensEqual(t *testing.T, name string, expected *PietTokens, got *PietTokens) {
+    if expected.Width() != got.Width() || expected.Height() != got.Height() {
+        t.Errorf("%s: expected %dx%d tokens, got %dx%d", name, expected.Width(), expected.Height(), got.Width(), got.Height())
+        return
+    }
+    if expected.Size() != got.Size() {
+        t.Errorf("%s: expected %d shapes, got %d", name, expected.Size(), got.Size())
+        return
+    }
+    for x := 0; x < expected.Width(); x++ {
+        for y := 0; y < expected.Height(); y++ {
+            e, g := expected.At(x, y), got.At(x, y)
+            if expected.data[x][y] != got.data[x][y] || e.Color != g.Color || e.Size != g.Size {
+                t.Errorf("%s: tokens differ at (%d, %d)", name, x, y)
+                return
+            }
+        }
+    }
+}
+
+func TestTokenizeColorModels(t *testing.T) {
+    src, err := ReadImage("../examples/Piet_Hello_World.gif")
+    if err != nil {
+        t.Fatal(err)
+    }
+    expected := Tokenize(src)
+    for _, shape := range expected.shapes {
+        if shape.Color == Unrecoganized {
+            t.Fatalf("Source image contains unrecognized colors")
+        }
+    }
+
+    bounds := src.Bounds()
+    rgba := image.NewRGBA(bounds)
+    nrgba := image.NewNRGBA(bounds)
+    rgba64 := image.NewRGBA64(bounds)
+    for _, dst := range []draw.Image{rgba, nrgba, rgba64} {
+        draw.Draw(dst, bounds, src, bounds.Min, draw.Src)
+    }
+
+    encoded := map[string]func(*bytes.Buffer) error {
+        "paletted gif": func(b *bytes.Buffer) error { return gif.Encode(b, src, nil) },
+        "rgba png": func(b *bytes.Buffer) error { return png.Encode(b, rgba) },
+        "nrgba png": func(b *bytes.Buffer) error { return png.Encode(b, nrgba) },
+        "16-bit png": func(b *bytes.Buffer) error { return png.Encode(b, rgba64) },
+    }
+    for name, encode := range encoded {
+        var buf bytes.Buffer
+        if err := encode(&buf); err != nil {
+            t.Errorf("%s: %s", name, err)
+            continue
+        }
+        img, _, err := image.Decode(&buf)
+        if err != nil {
+            t.Errorf("%s: %s", name, err)
+            continue
+        }
+        tokensEqual(t, name, expected, Tokenize(img))
+    }
+}
+
+func TestColorToColModels(t *testing.T) {
+    cases := []struct {
+        c color.Color
+        expected Col
+    }{
+        {color.NRGBA{R:high, G:mid, B:mid, A:high}, LightRed},
+        {color.RGBA64{R:0xFFFF, B:0xFFFF, A:0xFFFF}, MediumMagenta},
+        {color.NRGBA64{G:0xC0C0, A:0xFFFF}, DarkGreen},
+        {color.Gray{Y:high}, White},
+        {color.Gray16{Y:0}, Black},
+        {color.RGBA64{R:0xFF00, A:0xFFFF}, MediumRed},
+        {color.RGBA64{R:0xFE00, A:0xFFFF}, Unrecoganized},
+    }
+    for _, c := range cases {
+        if got := ColorToCol(c.c); got != c.expected {
+            t.Errorf("Expected %v to map to %d, got %d", c.c, c.expected, got)
+        }
+    }
+}
@@ -0,0 +1,384 @@
+package piet
+
+import (
+    "image"
+    "io"
+    "strings"
+    "testing"
+)
+
+func TestStrictInterpreter(t *testing.T) {
+    cases := []struct {
+        name string
+        calls []Call
+        reason string
+        stack string
+    }{
+        {"underflow", []Call{{Op: Push, Args: []int32{1}}, {Op: Add}}, "stack underflow", "[1]"},
+        {"pop underflow", []Call{{Op: Pop}}, "stack underflow", "[]"},
+        {"division by zero", []Call{{Op: Push, Args: []int32{4}}, {Op: Push, Args: []int32{0}}, {Op: Div}}, "division by zero", "[4, 0]"},
+        {"modulo by zero", []Call{{Op: Push, Args: []int32{4}}, {Op: Push, Args: []int32{0}}, {Op: Mod}}, "modulo by zero", "[4, 0]"},
+        {"negative roll", []Call{{Op: Push, Args: []int32{3}}, {Op: Push, Args: []int32{-1}}, {Op: Push, Args: []int32{1}}, {Op: Roll}}, "negative roll depth", "[3, -1, 1]"},
+        {"deep roll", []Call{{Op: Push, Args: []int32{5}}, {Op: Push, Args: []int32{1}}, {Op: Roll}}, "roll depth exceeds the stack", "[5, 1]"},
+    }
+    for _, c := range cases {
+        block := StmtBlock{}
+        for _, call := range c.calls {
+            block.Append(call)
+        }
+        failing := &block.Children[len(block.Children) - 1]
+        *failing = Call{Op: c.calls[len(c.calls) - 1].Op, Pos: image.Point{X: 3, Y: 4}, Dp: DpDown, Cc: CcRight}
+
+        interpreter := NewInterpreter(16)
+        interpreter.Strict = true
+        _, err := interpreter.Interpret(block)
+        execErr, ok := err.(Error)
+        if !ok {
+            t.Errorf("%s: expected an Error, got %v", c.name, err)
+            continue
+        }
+        if execErr.Reason != c.reason {
+            t.Errorf("%s: expected reason %q, got %q", c.name, c.reason, execErr.Reason)
+        }
+        if execErr.Stack != c.stack {
+            t.Errorf("%s: expected stack %s, got %s", c.name, c.stack, execErr.Stack)
+        }
+        if execErr.X != 3 || execErr.Y != 4 || execErr.Op != c.calls[len(c.calls) - 1].Op || execErr.Dp != DpDown || execErr.Cc != CcRight {
+            t.Errorf("%s: expected the failing call's op, position and pointer, got %v", c.name, execErr)
+        }
+
+        if c.reason == "stack underflow" {
+            interpreter = NewInterpreter(16)
+            if _, err := interpreter.Interpret(block); err != nil {
+                t.Errorf("%s: expected a lenient interpreter to ignore the op, got %v", c.name, err)
+            }
+        }
+    }
+}
+
+func TestStrictParse(t *testing.T) {
+    tImg := NewTestImage(3, 1)
+    tImg.Set(0, 0, colToColor[LightRed])
+    tImg.Set(1, 0, colToColor[LightYellow])
+    tImg.Set(2, 0, colToColor[MediumYellow])
+
+    // light red -> light yellow is an add on an empty stack
+    tokens := Tokenize(tImg)
+    root, ok := ParseStmtWith(tokens, ParseOptions{Capacity: 16, Strict: true})
+    if !ok {
+        t.Fatal("Expected the trace to finish")
+    }
+    last, isCall := root.Children[len(root.Children) - 2].(Call)
+    if !isCall || last.Op != Add || last.Pos != (image.Point{X: 1, Y: 0}) {
+        t.Errorf("Expected the failing add at (1, 0) before the trap, got %v", root.Children[len(root.Children) - 2])
+    }
+    trap, isTrap := root.Children[len(root.Children) - 1].(Trap)
+    if !isTrap || trap.Call.Op != Add || trap.Reason != "stack underflow" {
+        t.Errorf("Expected the trace to end with a trap for the add, got %v", root.Children[len(root.Children) - 1])
+    }
+
+    // the lenient trace skips the add and bounces between the blocks forever
+    root, ok = ParseStmtWith(tokens, ParseOptions{Capacity: 16, MaxCalls: 100})
+    if ok {
+        t.Errorf("Expected the lenient trace to hit the call limit")
+    }
+    if first := root.Children[0].(Call); first.Op != Push || first.Pos != (image.Point{X: 2, Y: 0}) {
+        t.Errorf("Expected a lenient trace to skip the add, got %v", first)
+    }
+}
+
+// linearProgram lays out single codel blocks along the top row so that every
+// transition performs the next op, pushes always push 1. The last block is an
+// L shape boxed in by black so the program ends there.
+func linearProgram(ops ...Op) *PietImage {
+    width := len(ops) + 2
+    img := NewPietImage(width, 2)
+    img.SetRect(img.Bounds(), Black)
+    col := LightRed
+    img.Set(0, 0, col)
+    for i, op := range ops {
+        for next := LightRed; next < White; next++ {
+            if col.ToOp(next) == op {
+                col = next
+                break
+            }
+        }
+        img.Set(i + 1, 0, col)
+    }
+    for trap := LightRed; trap < White; trap++ {
+        if col.ToOp(trap) == Push {
+            img.Set(width - 1, 0, trap)
+            img.Set(width - 1, 1, trap)
+            img.Set(width - 2, 1, trap)
+            break
+        }
+    }
+    return img
+}
+
+func TestDivModConformance(t *testing.T) {
+    cases := []struct {
+        s, f int32
+        div, mod int32
+    }{
+        {7, 2, 3, 1},
+        {-7, 2, -4, 1},
+        {7, -2, -4, -1},
+        {-7, -2, 3, -1},
+        {6, 3, 2, 0},
+        {-6, 3, -2, 0},
+        {6, -3, -2, 0},
+        {-6, -3, 2, 0},
+        {0, 5, 0, 0},
+        {0, -5, 0, 0},
+        {1, 5, 0, 1},
+        {-1, 5, -1, 4},
+        {1, -5, -1, -4},
+        {-2147483648, -1, -2147483648, 0},
+    }
+    for _, c := range cases {
+        if got := FloorDiv(c.s, c.f); got != c.div {
+            t.Errorf("FloorDiv(%d, %d) = %d expected %d", c.s, c.f, got, c.div)
+        }
+        if got := FloorMod(c.s, c.f); got != c.mod {
+            t.Errorf("FloorMod(%d, %d) = %d expected %d", c.s, c.f, got, c.mod)
+        }
+        for op, expected := range map[Op]int32{Div: c.div, Mod: c.mod} {
+            interpreter := NewInterpreter(8)
+            block := StmtBlock{}
+            block.Append(Call{Op: Push, Args: []int32{c.s}})
+            block.Append(Call{Op: Push, Args: []int32{c.f}})
+            block.Append(Call{Op: op})
+            if _, err := interpreter.Interpret(block); err != nil {
+                t.Errorf("%s %d %d: %s", op, c.s, c.f, err)
+            }
+            if got, _ := interpreter.Stack.Pop(); got != expected || interpreter.Stack.Len() != 0 {
+                t.Errorf("%s %d %d: expected %d got %d with stack %s", op, c.s, c.f, expected, got, interpreter.Stack)
+            }
+        }
+    }
+}
+
+func TestDivModByZero(t *testing.T) {
+    for _, op := range []Op{Div, Mod} {
+        interpreter := NewInterpreter(8)
+        block := StmtBlock{}
+        block.Append(Call{Op: Push, Args: []int32{5}})
+        block.Append(Call{Op: Push, Args: []int32{0}})
+        block.Append(Call{Op: op})
+        if _, err := interpreter.Interpret(block); err != nil {
+            t.Errorf("%s: expected division by zero to be ignored, got %s", op, err)
+        }
+        if interpreter.Stack.String() != "[5, 0]" {
+            t.Errorf("%s: expected the operands to stay on the stack, got %s", op, interpreter.Stack)
+        }
+
+        // 1 1 1 sub leaves [1, 0] for the op, which the trace must survive, and
+        // entering the trap pushes one more value
+        tokens := Tokenize(linearProgram(Push, Push, Push, Sub, op, Push, Add))
+        root, ok := ParseStmtWith(tokens, ParseOptions{Capacity: 8, MaxCalls: 200})
+        if !ok {
+            t.Fatalf("%s: expected the program to finish", op)
+        }
+        interpreter = NewInterpreterWith(8, strings.NewReader(""), io.Discard)
+        if result, err := interpreter.Interpret(root); err != nil || !result.Exited {
+            t.Errorf("%s: expected the program to exit, got %v %v", op, result, err)
+        }
+        if interpreter.Stack.String() != "[1, 1, 1]" {
+            t.Errorf("%s: expected [1, 1, 1] after ignoring the op, got %s", op, interpreter.Stack)
+        }
+    }
+}
+
+func TestTraceAfterInput(t *testing.T) {
+    // the trace reads -1 and has nothing left to add after the div, the
+    // interpreter still has to see the add for the inputs that leave 2 values
+    tokens := Tokenize(linearProgram(Push, NumIn, Div, Add, NumOut))
+    root, ok := ParseStmtWith(tokens, ParseOptions{Capacity: 8, MaxCalls: 200, Strict: true})
+    if !ok {
+        t.Fatalf("Expected the program to finish")
+    }
+    cases := []struct {
+        input string
+        expected string
+    }{
+        {"0", "1\n"},
+        {"2", "0\n"},
+        {"", "1\n"},
+    }
+    for _, c := range cases {
+        var output strings.Builder
+        interpreter := NewInterpreterWith(8, strings.NewReader(c.input), &output)
+        if _, err := interpreter.Interpret(root); err != nil {
+            t.Errorf("%q: Expected no error got %v", c.input, err)
+        }
+        if output.String() != c.expected {
+            t.Errorf("%q: Expected %q got %q", c.input, c.expected, output.String())
+        }
+    }
+}
+
+func TestRollIgnoredRestoresOperands(t *testing.T) {
+    interpreter := NewInterpreter(8)
+    block := StmtBlock{}
+    block.Append(Call{Op: Push, Args: []int32{7}})
+    block.Append(Call{Op: Push, Args: []int32{5}})
+    block.Append(Call{Op: Push, Args: []int32{1}})
+    block.Append(Call{Op: Roll})
+    if _, err := interpreter.Interpret(block); err != nil {
+        t.Fatal(err)
+    }
+    if interpreter.Stack.String() != "[7, 5, 1]" {
+        t.Errorf("Expected an ignored roll to restore its operands, got %s", interpreter.Stack)
+    }
+}
+
+func TestNot(t *testing.T) {
+    // push 1, not leaves [0] and entering the trap pushes one more value
+    tokens := Tokenize(linearProgram(Push, Not, Dup, Not))
+    root, ok := ParseStmtWith(tokens, ParseOptions{Capacity: 8, MaxCalls: 200})
+    if !ok {
+        t.Fatalf("Expected the program to finish")
+    }
+    interpreter := NewInterpreterWith(8, strings.NewReader(""), io.Discard)
+    if result, err := interpreter.Interpret(root); err != nil || !result.Exited {
+        t.Errorf("Expected the program to exit, got %v %v", result, err)
+    }
+    if interpreter.Stack.String() != "[0, 1, 1]" {
+        t.Errorf("Expected [0, 1, 1] after not, got %s", interpreter.Stack)
+    }
+}
+
+func TestNumIn(t *testing.T) {
+    cases := []struct {
+        input string
+        stack string
+        rest string
+    }{
+        {"42 -7\n+3 x", "[42, -7, 3]", "x"},
+        {"  2147483647 -2147483648 2147483648", "[2147483647, -2147483648]", ""},
+        {"-", "[]", ""},
+        {"\t\n99999999999999999999 5", "[5]", ""},
+        {"12abc", "[12]", "abc"},
+        {"", "[]", ""},
+    }
+    for _, c := range cases {
+        interpreter := NewInterpreterWith(8, strings.NewReader(c.input), io.Discard)
+        block := StmtBlock{}
+        for i := 0; i < 4; i++ {
+            block.Append(Call{Op: NumIn})
+        }
+        if _, err := interpreter.Interpret(block); err != nil {
+            t.Errorf("%q: %s", c.input, err)
+        }
+        if interpreter.Stack.String() != c.stack {
+            t.Errorf("%q: expected %s got %s", c.input, c.stack, interpreter.Stack)
+        }
+        if rest, _ := io.ReadAll(interpreter.Input); string(rest) != c.rest {
+            t.Errorf("%q: expected %q to be left unread, got %q", c.input, c.rest, rest)
+        }
+    }
+
+    interpreter := NewInterpreterWith(8, strings.NewReader(" x"), io.Discard)
+    interpreter.Strict = true
+    block := StmtBlock{}
+    block.Append(Call{Op: NumIn})
+    _, err := interpreter.Interpret(block)
+    if execErr, ok := err.(Error); !ok || execErr.Reason != `invalid number input 'x'` {
+        t.Errorf("Expected a strict interpreter to reject the input, got %v", err)
+    }
+}
+
+func TestCharIn(t *testing.T) {
+    cases := []struct {
+        encoding Encoding
+        input string
+        stack string
+    }{
+        {EncodingUTF8, "aé€😀", "[97, 233, 8364, 128512]"},
+        {EncodingUTF8, "\xff", "[65533]"},
+        {EncodingBytes, "aé", "[97, 195, 169]"},
+        {EncodingBytes, "", "[]"},
+    }
+    for _, c := range cases {
+        interpreter := NewInterpreterWith(8, strings.NewReader(c.input), io.Discard)
+        interpreter.Encoding = c.encoding
+        block := StmtBlock{}
+        for range c.input {
+            block.Append(Call{Op: CharIn})
+        }
+        block.Append(Call{Op: CharIn})
+        if _, err := interpreter.Interpret(block); err != nil {
+            t.Errorf("%s %q: %s", c.encoding, c.input, err)
+        }
+        if interpreter.Stack.String() != c.stack {
+            t.Errorf("%s %q: expected %s got %s", c.encoding, c.input, c.stack, interpreter.Stack)
+        }
+    }
+}
+
+func TestCompileEncoding(t *testing.T) {
+    block := StmtBlock{}
+    block.Append(Call{Op: CharIn})
+    block.Append(Call{Op: CharOut})
+    for encoding, routine := range map[Encoding]string{EncodingUTF8: "\nchout:", EncodingBytes: "\nchin:"} {
+        var asm strings.Builder
+        CompileTmpl(block, &asm, encoding)
+        if !strings.Contains(asm.String(), routine) {
+            t.Errorf("%s: expected the %s routine", encoding, strings.TrimSpace(routine))
+        }
+    }
+    if _, err := ParseEncoding("latin1"); err == nil {
+        t.Errorf("Expected an error for an unknown encoding")
+    }
+}
+
+func TestInterpretExamples(t *testing.T) {
+    cases := []struct {
+        filename string
+        codelSize int
+        output string
+    }{
+        // the programs end their output with a newline and exit writes another
+        {"../examples/Piet_Hello_World.gif", 11, "Hello, world!\n\n"},
+        {"../examples/nhello-big.gif", 4, "hello world!\n\n"},
+    }
+    for _, c := range cases {
+        img, err := ReadImage(c.filename)
+        if err != nil {
+            t.Fatal(err)
+        }
+        stmt := ParseStmt(Tokenize(NewCodelImage(img, c.codelSize)), 512)
+        var output strings.Builder
+        interpreter := NewInterpreterWith(512, strings.NewReader(""), &output)
+        result, err := interpreter.Interpret(stmt)
+        if err != nil {
+            t.Errorf("%s: %s", c.filename, err)
+        }
+        if !result.Exited {
+            t.Errorf("%s: expected the program to exit", c.filename)
+        }
+        if output.String() != c.output {
+            t.Errorf("%s: expected %q got %q", c.filename, c.output, output.String())
+        }
+    }
+}
+
+func TestInterpretExitStops(t *testing.T) {
+    block := StmtBlock{}
+    block.Append(Call{Op: Push, Args: []int32{65}})
+    block.Append(Call{Op: Exit})
+    block.Append(Call{Op: CharOut})
+    var output strings.Builder
+    interpreter := NewInterpreterWith(8, strings.NewReader(""), &output)
+    result, err := interpreter.Interpret(StmtBlock{Children: []Stmt{block, Call{Op: NumOut}}})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !result.Exited || result.Steps != 2 {
+        t.Errorf("Expected to exit after 2 steps, got %v", result)
+    }
+    if output.String() != "\n" || interpreter.Stack.String() != "[65]" {
+        t.Errorf("Expected nothing to run after the exit, got %q and %s", output.String(), interpreter.Stack)
+    }
+}
@@ -0,0 +1,395 @@
+package piet
+
+import (
+    "encoding/json"
+    "fmt"
+    "image"
+    "image/color"
+    "io"
+    "sort"
+)
+
+// LintCheck is the kind of mistake a LintIssue reports.
+type LintCheck byte
+const (
+    // LintUnknownColor is a block of pixels that aren't a Piet color.
+    LintUnknownColor LintCheck = 0
+    // LintUnreachable is a block the pointer can never enter.
+    LintUnreachable LintCheck = 1
+    // LintEdgeExit is a block the program stops at because the image edge
+    // blocks the pointer while one of its sides is open, see
+    // LintAccidentalTrap.
+    LintEdgeExit LintCheck = 2
+    // LintPushSize is a push whose block looks one codel too big or small.
+    LintPushSize LintCheck = 3
+    // LintWhiteLoop is the pointer sliding through white forever.
+    LintWhiteLoop LintCheck = 4
+    // LintMissingTrap is a program with no block that stops it.
+    LintMissingTrap LintCheck = 5
+    // LintAccidentalTrap is a block the program stops at because black
+    // covers the ends of a side the rest of which is open. The pointer only
+    // leaves from the ends, but a slightly different block would get out.
+    LintAccidentalTrap LintCheck = 6
+)
+func (l LintCheck) String() string {
+    switch l {
+    case LintUnknownColor:
+        return "unknown-color"
+    case LintUnreachable:
+        return "unreachable"
+    case LintEdgeExit:
+        return "edge-exit"
+    case LintPushSize:
+        return "push-size"
+    case LintWhiteLoop:
+        return "white-loop"
+    case LintMissingTrap:
+        return "missing-trap"
+    case LintAccidentalTrap:
+        return "accidental-trap"
+    default:
+        return "unknown"
+    }
+}
+func (l LintCheck) MarshalText() ([]byte, error) {
+    return []byte(l.String()), nil
+}
+
+// LintIssue is a likely mistake in a program. X and Y are the codel
+// coordinates of the block it is about.
+type LintIssue struct {
+    Check LintCheck `json:"check"`
+    X int `json:"x"`
+    Y int `json:"y"`
+    Message string `json:"message"`
+}
+func (i LintIssue) String() string {
+    return fmt.Sprintf("(%d, %d) %s: %s", i.X, i.Y, i.Check, i.Message)
+}
+
+type LintFormat byte
+const (
+    LintText LintFormat = 0
+    LintJSON LintFormat = 1
+)
+func (f LintFormat) String() string {
+    switch f {
+    case LintText:
+        return "text"
+    case LintJSON:
+        return "json"
+    default:
+        return "unknown"
+    }
+}
+func ParseLintFormat(name string) (LintFormat, error) {
+    for format := LintText; format <= LintJSON; format++ {
+        if format.String() == name {
+            return format, nil
+        }
+    }
+    return LintText, fmt.Errorf("unrecognized lint format %s, expected one of (text, json)", name)
+}
+
+// WriteLint writes issues to w as a line each or as a JSON array.
+func WriteLint(w io.Writer, issues []LintIssue, format LintFormat) error {
+    if format == LintJSON {
+        encoder := json.NewEncoder(w)
+        encoder.SetIndent("", "  ")
+        if issues == nil {
+            issues = []LintIssue{}
+        }
+        return encoder.Encode(issues)
+    }
+    for _, issue := range issues {
+        if _, err := fmt.Fprintln(w, issue); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// Lint looks for common mistakes in the program in img, loaded with opts. The
+// program graph is used like Reachable does, so pointer and switch ops are
+// assumed to be able to turn the pointer any way.
+func Lint(img image.Image, opts LoadOptions) ([]LintIssue, error) {
+    if opts.CodelSize == 0 {
+        opts.CodelSize = DetectCodelSize(img)
+    }
+    raw := img
+    if opts.CodelSize > 1 || img.Bounds().Min != (image.Point{}) {
+        sampled, err := NewSampledCodelImage(img, opts.CodelSize, opts.Sampling)
+        if err != nil {
+            return nil, err
+        }
+        raw = sampled
+    }
+    policy := opts.UnknownColor
+    if opts.UnknownColor == UnknownError {
+        // unknown colors are reported below rather than stopping the lint
+        opts.UnknownColor = UnknownWhite
+    }
+    prog, err := LoadWith(img, opts)
+    if err != nil {
+        return nil, err
+    }
+
+    l := linter{prog: prog, reported: map[LintCheck]map[int]bool{}}
+    l.unknownColors(raw, policy)
+    l.unreachable()
+    l.states()
+    sort.SliceStable(l.issues, func(i, j int) bool {
+        f, s := l.issues[i], l.issues[j]
+        if f.Y != s.Y {
+            return f.Y < s.Y
+        }
+        if f.X != s.X {
+            return f.X < s.X
+        }
+        return f.Check < s.Check
+    })
+    return l.issues, nil
+}
+
+type linter struct {
+    prog *Program
+    issues []LintIssue
+    // reported holds the blocks each check has reported, so a block entered
+    // in several ways is reported once
+    reported map[LintCheck]map[int]bool
+}
+
+func (l *linter) report(check LintCheck, block int, format string, args ...any) {
+    if l.reported[check] == nil {
+        l.reported[check] = map[int]bool{}
+    }
+    if l.reported[check][block] {
+        return
+    }
+    l.reported[check][block] = true
+    at := l.prog.blockCodel(block)
+    l.issues = append(l.issues, LintIssue{Check: check, X: at.X, Y: at.Y, Message: fmt.Sprintf(format, args...)})
+}
+
+func (l *linter) unknownColors(raw image.Image, policy UnknownColorPolicy) {
+    tokens := Tokenize(raw)
+    for _, shape := range tokens.shapes {
+        if shape.Color != Unrecoganized {
+            continue
+        }
+        left := shape.xEdges.MinNode()
+        c := color.NRGBAModel.Convert(raw.At(raw.Bounds().Min.X + left.Key, raw.Bounds().Min.Y + left.Min)).(color.NRGBA)
+        l.issues = append(l.issues, LintIssue{
+            Check: LintUnknownColor,
+            X: left.Key,
+            Y: left.Min,
+            Message: fmt.Sprintf("%d codels of #%02x%02x%02x aren't a Piet color and are read with the %s policy", shape.Size, c.R, c.G, c.B, policy),
+        })
+    }
+}
+
+func (l *linter) unreachable() {
+    reachable := l.prog.Reachable()
+    for idx, ok := range reachable {
+        shape := l.prog.Shape(idx)
+        if !ok && shape.Color != White && shape.Color != Black {
+            l.report(LintUnreachable, idx, "%s block of %d codels can't be reached from the start", shape.Color, shape.Size)
+        }
+    }
+}
+
+// states runs the checks that follow the pointer through the states reachable
+// from the start.
+func (l *linter) states() {
+    states := []BlockState{}
+    for state := range l.prog.AnalyzeStack().Depths {
+        states = append(states, state)
+    }
+    sort.Slice(states, func(i, j int) bool {
+        f, s := states[i], states[j]
+        if f.Block != s.Block {
+            return f.Block < s.Block
+        }
+        if f.Dp != s.Dp {
+            return f.Dp < s.Dp
+        }
+        return f.Cc < s.Cc
+    })
+
+    entrances := map[int]map[int]bool{}
+    for _, state := range states {
+        edge, ok := l.prog.GetEdge(state.Block, state.Dp, state.Cc)
+        if ok && edge.Target >= 0 && edge.Target != state.Block {
+            if entrances[edge.Target] == nil {
+                entrances[edge.Target] = map[int]bool{}
+            }
+            entrances[edge.Target][state.Block] = true
+        }
+    }
+
+    stops := false
+    for _, state := range states {
+        edge, ok := l.prog.GetEdge(state.Block, state.Dp, state.Cc)
+        if !ok {
+            continue
+        }
+        switch edge.Op {
+        case Exit:
+            stops = true
+            l.trap(state.Block, entrances[state.Block])
+        case Push:
+            l.pushSize(state, edge)
+        case Noop:
+            l.whiteLoop(state)
+        }
+    }
+    // the graph only approximates slides through white, so a trace that
+    // reaches its exit settles it
+    if start := l.prog.Start(); start >= 0 && !stops && !l.traceStops() {
+        l.report(LintMissingTrap, start, "no block the pointer can reach stops the program, it runs until it is interrupted")
+    }
+}
+
+// lintTraceCalls bounds the trace traceStops runs.
+const lintTraceCalls = 1 << 16
+
+// traceStops is true when the trace of the program reaches its exit.
+func (l *linter) traceStops() bool {
+    _, ok := ParseStmtWith(l.prog.tokens, ParseOptions{MaxCalls: lintTraceCalls})
+    return ok
+}
+
+// trap reports a block the program stops at when one of its sides is open.
+// A trap drawn with black, or with black and the image edge, is fine, and so
+// is an opening to one of entrances, the blocks the pointer enters it from.
+func (l *linter) trap(block int, entrances map[int]bool) {
+    if l.prog.Shape(block).Color == White {
+        return
+    }
+    edge, open, ok := l.sides(block, entrances)
+    if !ok {
+        return
+    }
+    if edge {
+        l.report(LintEdgeExit, block, "the program stops here because the image edge and black at the ends of the block's sides block the pointer, but (%d, %d) is open", open.X, open.Y)
+    } else {
+        l.report(LintAccidentalTrap, block, "the program stops here because black covers the ends of the block's sides, but (%d, %d) is open", open.X, open.Y)
+    }
+}
+
+// sides looks at the codels beyond the furthest row or column of block in
+// each direction, those the pointer can leave to. edge is true when one of
+// them is outside the image, open is the first one that isn't black or white
+// and isn't in one of entrances.
+func (l *linter) sides(block int, entrances map[int]bool) (edge bool, open image.Point, ok bool) {
+    shape := l.prog.Shape(block)
+    minX, maxX := shape.xEdges.MinNode().Key, shape.xEdges.MaxNode().Key
+    minY, maxY := shape.yEdges.MinNode().Key, shape.yEdges.MaxNode().Key
+    tokens := l.prog.tokens
+    for y := minY; y <= maxY; y++ {
+        for x := minX; x <= maxX; x++ {
+            if tokens.data[x][y] != block {
+                continue
+            }
+            beyond := []image.Point{}
+            if x == minX {
+                beyond = append(beyond, image.Point{X: x - 1, Y: y})
+            }
+            if x == maxX {
+                beyond = append(beyond, image.Point{X: x + 1, Y: y})
+            }
+            if y == minY {
+                beyond = append(beyond, image.Point{X: x, Y: y - 1})
+            }
+            if y == maxY {
+                beyond = append(beyond, image.Point{X: x, Y: y + 1})
+            }
+            for _, p := range beyond {
+                if !InBounds(p.X, p.Y, tokens.Width(), tokens.Height()) {
+                    edge = true
+                } else if col := tokens.At(p.X, p.Y).Color; !ok && col != Black && col != White && !entrances[tokens.data[p.X][p.Y]] {
+                    open, ok = p, true
+                }
+            }
+        }
+    }
+    return edge, open, ok
+}
+
+// pushSize looks for push blocks that are a rectangle missing one codel, and
+// pushes written as control characters when a value one off is printable.
+func (l *linter) pushSize(state BlockState, edge Edge) {
+    shape := l.prog.Shape(state.Block)
+    width := shape.xEdges.MaxNode().Key - shape.xEdges.MinNode().Key + 1
+    height := shape.yEdges.MaxNode().Key - shape.yEdges.MinNode().Key + 1
+    if gap, ok := l.gap(state.Block); ok {
+        l.report(LintPushSize, state.Block, "pushes %d, the block is a %dx%d rectangle missing the codel at (%d, %d)", shape.Size, width, height, gap.X, gap.Y)
+        return
+    }
+    next, ok := l.prog.GetEdge(edge.Target, edge.MoveDp, edge.MoveCc)
+    if !ok || next.Op != CharOut || printable(edge.Data) {
+        return
+    }
+    for _, other := range []int32{edge.Data + 1, edge.Data - 1} {
+        if printable(other) {
+            l.report(LintPushSize, state.Block, "pushes %d which out(char) writes as a control character, %d would write %q", edge.Data, other, rune(other))
+            return
+        }
+    }
+}
+
+// gap finds the codel missing from a block that fills its bounding box but
+// for one codel. A missing corner is how odd sizes are usually drawn so it
+// doesn't count.
+func (l *linter) gap(block int) (image.Point, bool) {
+    shape := l.prog.Shape(block)
+    minX, maxX := shape.xEdges.MinNode().Key, shape.xEdges.MaxNode().Key
+    minY, maxY := shape.yEdges.MinNode().Key, shape.yEdges.MaxNode().Key
+    if int(shape.Size) != (maxX - minX + 1) * (maxY - minY + 1) - 1 {
+        return image.Point{}, false
+    }
+    for x := minX; x <= maxX; x++ {
+        for y := minY; y <= maxY; y++ {
+            if l.prog.tokens.data[x][y] == block {
+                continue
+            }
+            corner := (x == minX || x == maxX) && (y == minY || y == maxY)
+            return image.Point{X: x, Y: y}, !corner
+        }
+    }
+    return image.Point{}, false
+}
+
+// printable is true for characters out(char) writes visibly, and newlines.
+func printable(val int32) bool {
+    return (val >= ' ' && val < 127) || val == '\n' || val == '\t' || val == '\r'
+}
+
+// whiteLoop follows the moves that don't perform an op from state, they only
+// pass through white, and reports it if they come back around.
+func (l *linter) whiteLoop(state BlockState) {
+    seen := map[BlockState]bool{}
+    cur := state
+    for !seen[cur] {
+        seen[cur] = true
+        edge, ok := l.prog.GetEdge(cur.Block, cur.Dp, cur.Cc)
+        if !ok || edge.Op != Noop {
+            return
+        }
+        cur = BlockState{edge.Target, edge.MoveDp, edge.MoveCc}
+    }
+    // cur is on the loop, report it once at its lowest block
+    lowest := cur.Block
+    for loop := l.after(cur); loop != cur; loop = l.after(loop) {
+        if loop.Block < lowest {
+            lowest = loop.Block
+        }
+    }
+    l.report(LintWhiteLoop, lowest, "the pointer slides through white forever without performing an op")
+}
+
+// after is the state the pointer is in after leaving state without an op.
+func (l *linter) after(state BlockState) BlockState {
+    edge, _ := l.prog.GetEdge(state.Block, state.Dp, state.Cc)
+    return BlockState{edge.Target, edge.MoveDp, edge.MoveCc}
+}
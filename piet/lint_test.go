@@ -0,0 +1,257 @@
+package piet
+
+import (
+    "encoding/json"
+    "image"
+    "image/color"
+    "strings"
+    "testing"
+)
+
+// bordered surrounds img with a codel of black on every side.
+func bordered(img *PietImage) *PietImage {
+    out := NewPietImage(img.Width() + 2, img.Height() + 2)
+    out.SetRect(out.Bounds(), Black)
+    for x := 0; x < img.Width(); x++ {
+        for y := 0; y < img.Height(); y++ {
+            out.Set(x + 1, y + 1, img.Col(x, y))
+        }
+    }
+    return out
+}
+
+func lintIssues(t *testing.T, img image.Image, opts LoadOptions) []LintIssue {
+    t.Helper()
+    if opts.CodelSize == 0 {
+        opts.CodelSize = 1
+    }
+    issues, err := Lint(img, opts)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return issues
+}
+
+func findIssue(issues []LintIssue, check LintCheck) (LintIssue, bool) {
+    for _, issue := range issues {
+        if issue.Check == check {
+            return issue, true
+        }
+    }
+    return LintIssue{}, false
+}
+
+// borderedProgram is a linear program moved off the origin so the trap is
+// surrounded by black, the start grows into the top left corner.
+func borderedProgram(ops ...Op) *PietImage {
+    img := bordered(linearProgram(ops...))
+    img.SetRect(image.Rect(0, 0, 2, 2), LightRed)
+    return img
+}
+
+func TestLintClean(t *testing.T) {
+    if issues := lintIssues(t, borderedProgram(Push, NumOut), LoadOptions{}); len(issues) != 0 {
+        t.Errorf("Expected no issues got %v", issues)
+    }
+}
+
+// openTrap stops the program at a block against the top edge whose bottom is
+// black at its ends and open in the middle, at (2, 2).
+func openTrap() *PietImage {
+    img := NewPietImage(5, 3)
+    img.SetRect(img.Bounds(), Black)
+    img.Set(0, 0, LightRed)
+    img.Set(1, 0, LightRed.Next(Push))
+    trap := LightRed.Next(Push).Next(NumOut)
+    img.Set(2, 0, trap)
+    img.SetRect(image.Rect(1, 1, 4, 2), trap)
+    img.Set(2, 2, DarkBlue)
+    return img
+}
+
+func TestLintEdgeExit(t *testing.T) {
+    issues := lintIssues(t, openTrap(), LoadOptions{})
+    issue, ok := findIssue(issues, LintEdgeExit)
+    if !ok {
+        t.Fatalf("Expected the open trap against the edge to be reported got %v", issues)
+    }
+    if !strings.Contains(issue.Message, "(2, 2) is open") {
+        t.Errorf("Expected (2, 2) to be open got %s", issue)
+    }
+    if _, ok := findIssue(issues, LintAccidentalTrap); ok {
+        t.Errorf("Expected the trap to be reported once got %v", issues)
+    }
+}
+
+func TestLintCornerTrap(t *testing.T) {
+    // the trap of a linear program is closed by black and the image edge
+    issues := lintIssues(t, linearProgram(Push, NumOut), LoadOptions{})
+    if len(issues) != 0 {
+        t.Errorf("Expected no issues got %v", issues)
+    }
+}
+
+func TestLintAccidentalTrap(t *testing.T) {
+    img := bordered(openTrap())
+    img.SetRect(image.Rect(0, 0, 2, 2), LightRed)
+    issues := lintIssues(t, img, LoadOptions{})
+    issue, ok := findIssue(issues, LintAccidentalTrap)
+    if !ok {
+        t.Fatalf("Expected the open trap to be reported got %v", issues)
+    }
+    if !strings.Contains(issue.Message, "(3, 3) is open") {
+        t.Errorf("Expected (3, 3) to be open got %s", issue)
+    }
+    if _, ok := findIssue(issues, LintEdgeExit); ok {
+        t.Errorf("Expected no edge exit inside the border got %v", issues)
+    }
+}
+
+func TestLintExampleTraps(t *testing.T) {
+    // both traps are open only where the pointer comes in
+    for _, c := range []struct{ name string; codelSize int }{{"Piet_Hello_World.gif", 11}, {"tetris.gif", 1}} {
+        img, err := ReadImage("../examples/" + c.name)
+        if err != nil {
+            t.Fatal(err)
+        }
+        for _, issue := range lintIssues(t, img, LoadOptions{CodelSize: c.codelSize}) {
+            if issue.Check != LintUnreachable {
+                t.Errorf("%s: Expected only unreachable blocks got %s", c.name, issue)
+            }
+        }
+    }
+}
+
+func TestLintMissingTrap(t *testing.T) {
+    img := NewPietImage(2, 1)
+    img.Set(0, 0, LightRed)
+    img.Set(1, 0, LightRed.Next(Push))
+    issues := lintIssues(t, img, LoadOptions{})
+    if _, ok := findIssue(issues, LintMissingTrap); !ok {
+        t.Errorf("Expected a missing trap got %v", issues)
+    }
+}
+
+func TestLintUnknownColor(t *testing.T) {
+    prog := borderedProgram(Push, NumOut)
+    img := image.NewNRGBA(prog.Bounds())
+    for x := 0; x < prog.Width(); x++ {
+        for y := 0; y < prog.Height(); y++ {
+            img.Set(x, y, prog.At(x, y))
+        }
+    }
+    img.Set(2, 3, color.NRGBA{0x12, 0x34, 0x56, 0xff})
+    for _, policy := range []UnknownColorPolicy{UnknownBlack, UnknownError} {
+        issues := lintIssues(t, img, LoadOptions{UnknownColor: policy})
+        issue, ok := findIssue(issues, LintUnknownColor)
+        if !ok {
+            t.Errorf("%s: expected an unknown color got %v", policy, issues)
+            continue
+        }
+        if issue.X != 2 || issue.Y != 3 || !strings.Contains(issue.Message, "#123456") {
+            t.Errorf("%s: expected #123456 at (2, 3) got %s", policy, issue)
+        }
+    }
+}
+
+func TestLintUnreachable(t *testing.T) {
+    img := NewPietImage(7, 6)
+    img.SetRect(img.Bounds(), Black)
+    prog := borderedProgram(Push, NumOut)
+    for x := 0; x < prog.Width(); x++ {
+        for y := 0; y < prog.Height(); y++ {
+            img.Set(x, y, prog.Col(x, y))
+        }
+    }
+    img.Set(2, 5, DarkGreen)
+    issues := lintIssues(t, img, LoadOptions{})
+    if len(issues) != 1 || issues[0].Check != LintUnreachable || issues[0].X != 2 || issues[0].Y != 5 {
+        t.Errorf("Expected the green codel at (2, 5) to be unreachable got %v", issues)
+    }
+}
+
+func TestLintPushSize(t *testing.T) {
+    cases := []struct {
+        name string
+        gap image.Point
+        reported bool
+    }{
+        {"hole", image.Point{X: 1, Y: 1}, true},
+        {"notch", image.Point{X: 1, Y: 0}, true},
+        {"corner", image.Point{X: 0, Y: 2}, false},
+    }
+    for _, c := range cases {
+        img := NewPietImage(5, 3)
+        img.SetRect(img.Bounds(), Black)
+        img.SetRect(image.Rect(0, 0, 3, 3), LightRed)
+        img.Set(c.gap.X, c.gap.Y, Black)
+        img.Set(3, 2, LightRed.Next(Push))
+        img.Set(3, 1, LightRed.Next(Push))
+        img.Set(3, 0, LightRed.Next(Push))
+        issues := lintIssues(t, img, LoadOptions{})
+        issue, ok := findIssue(issues, LintPushSize)
+        if ok != c.reported {
+            t.Errorf("%s: expected reported %t got %v", c.name, c.reported, issues)
+        } else if ok && (issue.X != 0 || issue.Y != 0 || !strings.Contains(issue.Message, "pushes 8")) {
+            t.Errorf("%s: expected the push of 8 at (0, 0) got %s", c.name, issue)
+        }
+    }
+}
+
+func TestLintWhiteLoop(t *testing.T) {
+    // the same color either side of white, the pointer bounces between them
+    img := NewPietImage(3, 1)
+    img.Set(0, 0, LightRed)
+    img.Set(2, 0, LightRed)
+    issues := lintIssues(t, img, LoadOptions{})
+    issue, ok := findIssue(issues, LintWhiteLoop)
+    if !ok {
+        t.Fatalf("Expected a white loop got %v", issues)
+    }
+    if issue.X != 0 || issue.Y != 0 {
+        t.Errorf("Expected the loop at (0, 0) got %s", issue)
+    }
+}
+
+func TestParseLintFormat(t *testing.T) {
+    for _, format := range []LintFormat{LintText, LintJSON} {
+        parsed, err := ParseLintFormat(format.String())
+        if err != nil || parsed != format {
+            t.Errorf("Expected %s got %s (%v)", format, parsed, err)
+        }
+    }
+    if _, err := ParseLintFormat("xml"); err == nil {
+        t.Errorf("Expected an error for xml")
+    }
+}
+
+func TestWriteLint(t *testing.T) {
+    issues := []LintIssue{{Check: LintUnreachable, X: 2, Y: 5, Message: "dark green block of 1 codels can't be reached from the start"}}
+    var text strings.Builder
+    if err := WriteLint(&text, issues, LintText); err != nil {
+        t.Fatal(err)
+    }
+    if expected := "(2, 5) unreachable: dark green block of 1 codels can't be reached from the start\n"; text.String() != expected {
+        t.Errorf("Expected %q got %q", expected, text.String())
+    }
+
+    var out strings.Builder
+    if err := WriteLint(&out, issues, LintJSON); err != nil {
+        t.Fatal(err)
+    }
+    decoded := []map[string]any{}
+    if err := json.Unmarshal([]byte(out.String()), &decoded); err != nil {
+        t.Fatal(err)
+    }
+    if len(decoded) != 1 || decoded[0]["check"] != "unreachable" || decoded[0]["x"] != float64(2) {
+        t.Errorf("Expected the issue as JSON got %s", out.String())
+    }
+
+    var empty strings.Builder
+    if err := WriteLint(&empty, nil, LintJSON); err != nil {
+        t.Fatal(err)
+    }
+    if strings.TrimSpace(empty.String()) != "[]" {
+        t.Errorf("Expected an empty array got %q", empty.String())
+    }
+}
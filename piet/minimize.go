@@ -0,0 +1,303 @@
+package piet
+
+import (
+    "bytes"
+    "context"
+    "fmt"
+    "image"
+    "strings"
+)
+
+type MinimizeMetric byte
+const (
+    MinimizeArea MinimizeMetric = 0
+    MinimizeCodels MinimizeMetric = 1
+)
+func (m MinimizeMetric) String() string {
+    switch m {
+    case MinimizeArea:
+        return "area"
+    case MinimizeCodels:
+        return "codels"
+    default:
+        return "unknown"
+    }
+}
+func ParseMinimizeMetric(name string) (MinimizeMetric, error) {
+    for metric := MinimizeArea; metric <= MinimizeCodels; metric++ {
+        if metric.String() == name {
+            return metric, nil
+        }
+    }
+    return MinimizeArea, fmt.Errorf("unrecognized metric %s, expected one of (area, codels)", name)
+}
+
+// maxTraceCalls bounds how long the program being minimized may run.
+const maxTraceCalls = 1 << 20
+
+// Minimize searches for a smaller image that behaves like img. Colour blocks
+// that can't be reached are painted black, blocks whose size doesn't matter
+// are shrunk to a single codel, then rows and columns are deleted one at a
+// time. With MinimizeCodels individual codels are also painted black so the
+// number of non-black codels goes down.
+//
+// A step is only kept when the resulting program still traces to the same
+// stack effects and, run on each of inputs, prints the same output and ends
+// with the same error as the original. No inputs runs it on empty input. A
+// program that reads input is only known to behave the same on the inputs
+// it was tried with.
+func Minimize(img *PietImage, capacity int, metric MinimizeMetric, inputs [][]byte) (*PietImage, error) {
+    if len(inputs) == 0 {
+        inputs = [][]byte{{}}
+    }
+    reference, ok := traceEffects(img, capacity, maxTraceCalls)
+    if !ok {
+        return nil, fmt.Errorf("program did not finish within %d calls", maxTraceCalls)
+    }
+    outcomes, steps, ok := runOutcomes(img, capacity, inputs, maxTraceCalls)
+    if !ok {
+        return nil, fmt.Errorf("program did not finish within %d steps", maxTraceCalls)
+    }
+    limit := 4 * len(reference) + 64
+    stepLimit := 4 * steps + 64
+    equivalent := func(candidate *PietImage) bool {
+        if candidate.Width() == 0 || candidate.Height() == 0 {
+            return false
+        }
+        if effects, ok := traceEffects(candidate, capacity, limit); !ok || !sameCalls(reference, effects) {
+            return false
+        }
+        candidateOutcomes, _, ok := runOutcomes(candidate, capacity, inputs, stepLimit)
+        if !ok {
+            return false
+        }
+        for i := range outcomes {
+            if outcomes[i] != candidateOutcomes[i] {
+                return false
+            }
+        }
+        return true
+    }
+
+    result := img.Clone()
+    result = blackenUnreachable(result, equivalent)
+    result = shrinkBlocks(result, equivalent)
+    for changed := true; changed; {
+        changed = false
+        for x := result.Width() - 1; x >= 0; x-- {
+            if candidate := result.WithoutColumn(x); equivalent(candidate) {
+                result = candidate
+                changed = true
+            }
+        }
+        for y := result.Height() - 1; y >= 0; y-- {
+            if candidate := result.WithoutRow(y); equivalent(candidate) {
+                result = candidate
+                changed = true
+            }
+        }
+    }
+    if metric == MinimizeCodels {
+        for x := 0; x < result.Width(); x++ {
+            for y := 0; y < result.Height(); y++ {
+                if (x == 0 && y == 0) || result.Col(x, y) == Black {
+                    continue
+                }
+                col := result.Col(x, y)
+                result.Set(x, y, Black)
+                if !equivalent(result) {
+                    result.Set(x, y, col)
+                }
+            }
+        }
+    }
+    return result, nil
+}
+
+// shrinkBlocks paints all but one codel of each colour block black. The size
+// of a block is what it pushes, so this only sticks for blocks that are never
+// pushed from. Each codel of the block is tried as the one that is kept.
+func shrinkBlocks(img *PietImage, equivalent func(*PietImage) bool) *PietImage {
+    tokens := Tokenize(img)
+    for idx, shape := range tokens.shapes {
+        if shape.Size < 2 || shape.Color == Black || shape.Color == White {
+            continue
+        }
+        codels := []image.Point{}
+        for x := 0; x < tokens.Width(); x++ {
+            for y := 0; y < tokens.Height(); y++ {
+                if tokens.data[x][y] == idx {
+                    codels = append(codels, image.Point{X: x, Y: y})
+                }
+            }
+        }
+        for _, kept := range codels {
+            candidate := img.Clone()
+            for _, codel := range codels {
+                if codel != kept {
+                    candidate.Set(codel.X, codel.Y, Black)
+                }
+            }
+            if equivalent(candidate) {
+                img = candidate
+                break
+            }
+        }
+    }
+    return img
+}
+
+func blackenUnreachable(img *PietImage, equivalent func(*PietImage) bool) *PietImage {
+    tokens := Tokenize(img)
+    reachable := Parse(tokens).Reachable()
+    unreachable := []int{}
+    for idx, shape := range tokens.shapes {
+        if !reachable[idx] && shape.Color != Black && shape.Color != White {
+            unreachable = append(unreachable, idx)
+        }
+    }
+    paint := func(target *PietImage, indexes []int) *PietImage {
+        painted := map[int]bool{}
+        for _, idx := range indexes {
+            painted[idx] = true
+        }
+        candidate := target.Clone()
+        for x := 0; x < tokens.Width(); x++ {
+            for y := 0; y < tokens.Height(); y++ {
+                if painted[tokens.data[x][y]] {
+                    candidate.Set(x, y, Black)
+                }
+            }
+        }
+        return candidate
+    }
+    if candidate := paint(img, unreachable); equivalent(candidate) {
+        return candidate
+    }
+    for _, idx := range unreachable {
+        if candidate := paint(img, []int{idx}); equivalent(candidate) {
+            img = candidate
+        }
+    }
+    return img
+}
+
+// traceEffects traces img and keeps only the calls that can change what the
+// interpreter outputs, see stackEffects.
+func traceEffects(img *PietImage, capacity int, maxCalls int) ([]Call, bool) {
+    root, ok := ParseStmtWith(Tokenize(img), ParseOptions{Capacity: capacity, MaxCalls: maxCalls})
+    if !ok {
+        return nil, false
+    }
+    return stackEffects(root), true
+}
+
+// stackEffects drops the calls that can't change the interpreter's output:
+// the switch and pointer calls ParseStmt emits with an argument for white
+// blocks and blocked moves, and a value that is pushed or duplicated and then
+// immediately removed again by pop, pointer or switch.
+func stackEffects(block StmtBlock) []Call {
+    result := []Call{}
+    for _, stmt := range block.Children {
+        call, ok := stmt.(Call)
+        if !ok || ((call.Op == Pointer || call.Op == Switch) && len(call.Args) > 0) {
+            continue
+        }
+        if call.Op == Pop || call.Op == Pointer || call.Op == Switch {
+            if n := len(result); n > 0 && (result[n - 1].Op == Push || result[n - 1].Op == Dup) {
+                result = result[:n - 1]
+                continue
+            }
+        }
+        result = append(result, call)
+    }
+    return result
+}
+
+// runOutcome is what a run of the program being minimized printed and the
+// error it ended with. The position of an error is left out, it moves when
+// the image shrinks.
+type runOutcome struct {
+    output string
+    err string
+}
+
+// runOutcomes runs img on each of inputs. It returns false if a run was
+// stopped by maxSteps, steps is the most steps any of the runs took.
+func runOutcomes(img *PietImage, capacity int, inputs [][]byte, maxSteps int) (outcomes []runOutcome, steps int, ok bool) {
+    prog := Parse(Tokenize(img))
+    for _, input := range inputs {
+        var output strings.Builder
+        result, err := Run(context.Background(), prog, bytes.NewReader(input), &output, Options{Capacity: capacity, MaxSteps: maxSteps})
+        outcome := runOutcome{output: output.String()}
+        switch e := err.(type) {
+        case nil:
+        case LimitError:
+            return nil, 0, false
+        case Error:
+            outcome.err = fmt.Sprintf("%s: %s, stack %s", e.Op, e.Reason, e.Stack)
+        default:
+            outcome.err = e.Error()
+        }
+        outcomes = append(outcomes, outcome)
+        if result.Steps > steps {
+            steps = result.Steps
+        }
+    }
+    return outcomes, steps, true
+}
+
+func sameCalls(f []Call, s []Call) bool {
+    if len(f) != len(s) {
+        return false
+    }
+    for i := range f {
+        if f[i].Op != s[i].Op || len(f[i].Args) != len(s[i].Args) {
+            return false
+        }
+        for j := range f[i].Args {
+            if f[i].Args[j] != s[i].Args[j] {
+                return false
+            }
+        }
+    }
+    return true
+}
+
+func (p *PietImage) Clone() *PietImage {
+    clone := PietImage{cols: make([][]Col, p.Width())}
+    for x := range p.cols {
+        clone.cols[x] = append([]Col{}, p.cols[x]...)
+    }
+    return &clone
+}
+
+func (p *PietImage) WithoutColumn(col int) *PietImage {
+    result := PietImage{}
+    for x := range p.cols {
+        if x != col {
+            result.cols = append(result.cols, append([]Col{}, p.cols[x]...))
+        }
+    }
+    return &result
+}
+
+func (p *PietImage) WithoutRow(row int) *PietImage {
+    result := PietImage{cols: make([][]Col, p.Width())}
+    for x := range p.cols {
+        result.cols[x] = append(append([]Col{}, p.cols[x][:row]...), p.cols[x][row + 1:]...)
+    }
+    return &result
+}
+
+func (p *PietImage) CodelCount() int {
+    count := 0
+    for x := range p.cols {
+        for _, col := range p.cols[x] {
+            if col != Black {
+                count += 1
+            }
+        }
+    }
+    return count
+}
@@ -0,0 +1,131 @@
+package piet
+
+import (
+    "image"
+    "testing"
+)
+
+func TestMinimize(t *testing.T) {
+    src, err := ReadImage("../examples/Piet_Hello_World.gif")
+    if err != nil {
+        t.Fatal(err)
+    }
+    original := PietImageFromImage(NewCodelImage(src, 11))
+
+    // pad the program with black columns and an unreachable block
+    padded := NewPietImage(original.Width() + 3, original.Height() + 2)
+    padded.SetRect(padded.Bounds(), Black)
+    for x := 0; x < original.Width(); x++ {
+        for y := 0; y < original.Height(); y++ {
+            padded.Set(x, y, original.Col(x, y))
+        }
+    }
+    padded.SetRect(image.Rect(original.Width() + 1, 2, original.Width() + 3, 4), LightGreen)
+
+    expected, ok := traceEffects(original, 512, maxTraceCalls)
+    if !ok {
+        t.Fatal("Expected the original program to finish")
+    }
+    for _, metric := range []MinimizeMetric{MinimizeArea, MinimizeCodels} {
+        minimized, err := Minimize(padded, 512, metric, nil)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if minimized.Width() * minimized.Height() > original.Width() * original.Height() {
+            t.Errorf("%s: expected at most %d codels, got %dx%d", metric, original.Width() * original.Height(), minimized.Width(), minimized.Height())
+        }
+        effects, ok := traceEffects(minimized, 512, maxTraceCalls)
+        if !ok || !sameCalls(expected, effects) {
+            t.Errorf("%s: minimized program behaves differently", metric)
+        }
+        if metric == MinimizeCodels && minimized.CodelCount() >= original.CodelCount() {
+            t.Errorf("Expected fewer than %d non-black codels, got %d", original.CodelCount(), minimized.CodelCount())
+        }
+    }
+}
+
+func TestMinimizeWithInputs(t *testing.T) {
+    // widen the first block of in(number) out(number), it is never pushed
+    // from so one codel of it is enough
+    program := linearProgram(NumIn, NumOut)
+    img := NewPietImage(program.Width() + 1, program.Height())
+    for x := 0; x < program.Width(); x++ {
+        for y := 0; y < program.Height(); y++ {
+            img.Set(x + 1, y, program.Col(x, y))
+        }
+    }
+    img.Set(0, 0, LightRed)
+    img.Set(0, 1, LightRed)
+    img.Set(1, 1, LightRed)
+
+    inputs := [][]byte{[]byte("5"), []byte("-3"), []byte("")}
+    minimized, err := Minimize(img, 16, MinimizeArea, inputs)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if minimized.Width() * minimized.Height() >= img.Width() * img.Height() {
+        t.Errorf("Expected fewer than %d codels, got %dx%d", img.Width() * img.Height(), minimized.Width(), minimized.Height())
+    }
+    for _, input := range inputs {
+        expected, _, _ := runOutcomes(img, 16, [][]byte{input}, 1000)
+        got, _, ok := runOutcomes(minimized, 16, [][]byte{input}, 1000)
+        if !ok || got[0] != expected[0] {
+            t.Errorf("%q: Expected %v got %v", input, expected, got)
+        }
+    }
+}
+
+func TestShrinkBlocks(t *testing.T) {
+    program := linearProgram(Push, NumIn, Add, NumOut)
+    img := NewPietImage(program.Width() + 1, program.Height())
+    for x := 0; x < program.Width(); x++ {
+        for y := 0; y < program.Height(); y++ {
+            img.Set(x + 1, y, program.Col(x, y))
+        }
+    }
+    // a block of two that pushes 2 and a block of three that is left with in(number)
+    img.Set(0, 0, LightRed)
+    img.Set(0, 1, Black)
+    img.Set(1, 1, img.Col(2, 0))
+    img.Set(2, 1, img.Col(2, 0))
+    equivalent := func(candidate *PietImage) bool {
+        expected, _, _ := runOutcomes(img, 16, [][]byte{[]byte("7")}, 1000)
+        got, _, ok := runOutcomes(candidate, 16, [][]byte{[]byte("7")}, 1000)
+        return ok && got[0] == expected[0]
+    }
+    shrunk := shrinkBlocks(img, equivalent)
+    if shrunk.Col(0, 0) != LightRed || shrunk.Col(1, 0) != LightRed {
+        t.Errorf("Expected the block that pushes to keep its size")
+    }
+    if shrunk.CodelCount() != img.CodelCount() - 2 {
+        t.Errorf("Expected the in(number) block to shrink to one codel, got %d of %d codels", shrunk.CodelCount(), img.CodelCount())
+    }
+}
+
+func TestStackEffects(t *testing.T) {
+    block := StmtBlock{}
+    block.Append(Call{Op: NumIn})
+    block.Append(Call{Op: Push, Args: []int32{1}})
+    block.Append(Call{Op: Dup})
+    block.Append(Call{Op: Switch})
+    block.Append(Call{Op: Pointer})
+    block.Append(Call{Op: Push, Args: []int32{1}})
+    block.Append(Call{Op: Switch})
+    block.Append(Call{Op: Pointer})
+    block.Append(Call{Op: CharOut})
+
+    effects := stackEffects(block)
+    expected := []Call{{Op: NumIn}, {Op: Pointer}, {Op: CharOut}}
+    if !sameCalls(expected, effects) {
+        t.Errorf("Expected %v, got %v", expected, effects)
+    }
+}
+
+func TestParseMinimizeMetric(t *testing.T) {
+    if metric, err := ParseMinimizeMetric("codels"); err != nil || metric != MinimizeCodels {
+        t.Errorf("Expected codels, got %s %v", metric, err)
+    }
+    if _, err := ParseMinimizeMetric("volume"); err == nil {
+        t.Errorf("Expected an error for an unknown metric")
+    }
+}
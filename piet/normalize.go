@@ -0,0 +1,170 @@
+package piet
+
+import (
+    "fmt"
+    "image"
+    "image/color"
+    "io"
+    "sort"
+)
+
+type ColorCount struct {
+    Color color.RGBA
+    Col Col
+    Count int
+}
+func (c ColorCount) Changed() bool {
+    return ColorToCol(c.Color) != c.Col
+}
+
+type NormalizeReport struct {
+    Size image.Point
+    Trimmed image.Rectangle
+    CodelSize int
+    Mismatches int
+    Colors []ColorCount
+}
+func (r *NormalizeReport) Write(w io.Writer) {
+    fmt.Fprintf(w, "image %dx%d\n", r.Size.X, r.Size.Y)
+    if r.Trimmed.Size() != r.Size {
+        fmt.Fprintf(w, "dropped border, kept %v\n", r.Trimmed)
+    }
+    fmt.Fprintf(w, "codel size %d", r.CodelSize)
+    if r.Mismatches > 0 {
+        fmt.Fprintf(w, ", %d codels contained more than one color", r.Mismatches)
+    }
+    fmt.Fprintln(w)
+    changed := 0
+    for _, c := range r.Colors {
+        status := ""
+        if c.Changed() {
+            status = " (changed)"
+            changed += c.Count
+        }
+        fmt.Fprintf(w, "  #%02x%02x%02x -> %-14s %d pixels%s\n", c.Color.R, c.Color.G, c.Color.B, c.Col, c.Count, status)
+    }
+    fmt.Fprintf(w, "%d of %d pixels changed\n", changed, r.Size.X * r.Size.Y)
+}
+
+// Normalize snaps every pixel of img to a Piet color using policy, drops a
+// uniform black border when the program would not otherwise start on a color
+// block and reduces the codels to a single pixel. A codelSize of 0 detects it.
+func Normalize(img image.Image, policy UnknownColorPolicy, codelSize int) (*PietImage, *NormalizeReport, error) {
+    report := NormalizeReport{
+        Size: img.Bounds().Size(),
+    }
+    policyImg, err := NewPolicyImage(img, policy)
+    if err != nil {
+        return nil, nil, err
+    }
+    for _, count := range countColors(img) {
+        count.Col = ColorToCol(policyImg.At(count.At.X, count.At.Y))
+        report.Colors = append(report.Colors, count.ColorCount)
+    }
+
+    report.Trimmed = trimBorder(img, policyImg)
+    trimmed := subImage{img: policyImg, rect: report.Trimmed}
+
+    if codelSize == 0 {
+        codelSize = DetectCodelSize(trimmed)
+    }
+    report.CodelSize = codelSize
+    report.Mismatches = len(CodelMismatches(trimmed, codelSize))
+    codelImg, err := NewSampledCodelImage(trimmed, codelSize, SampleMajority)
+    if err != nil {
+        return nil, nil, err
+    }
+    return PietImageFromImage(codelImg), &report, nil
+}
+
+// trimBorder removes rows and columns from the outside of img for as long as
+// they consist of a single color that is black after the policy is applied,
+// e.g. a frame drawn around the program. Black blocks the pointer just like
+// the edge of the image does, so dropping it doesn't change what the program
+// does. A white frame is kept, the pointer can slide through it.
+func trimBorder(img image.Image, policyImg image.Image) image.Rectangle {
+    rect := img.Bounds()
+    if rect.Empty() {
+        return rect
+    }
+    border := img.At(rect.Min.X, rect.Min.Y)
+    if ColorToCol(policyImg.At(rect.Min.X, rect.Min.Y)) != Black {
+        return rect
+    }
+    uniformLine := func(line image.Rectangle) bool {
+        for y := line.Min.Y; y < line.Max.Y; y++ {
+            for x := line.Min.X; x < line.Max.X; x++ {
+                if !sameColor(border, img.At(x, y)) {
+                    return false
+                }
+            }
+        }
+        return true
+    }
+    for trimmed := true; trimmed && rect.Dx() > 1 && rect.Dy() > 1; {
+        trimmed = false
+        if uniformLine(image.Rect(rect.Min.X, rect.Min.Y, rect.Max.X, rect.Min.Y + 1)) {
+            rect.Min.Y += 1
+            trimmed = true
+        }
+        if uniformLine(image.Rect(rect.Min.X, rect.Max.Y - 1, rect.Max.X, rect.Max.Y)) {
+            rect.Max.Y -= 1
+            trimmed = true
+        }
+        if uniformLine(image.Rect(rect.Min.X, rect.Min.Y, rect.Min.X + 1, rect.Max.Y)) {
+            rect.Min.X += 1
+            trimmed = true
+        }
+        if uniformLine(image.Rect(rect.Max.X - 1, rect.Min.Y, rect.Max.X, rect.Max.Y)) {
+            rect.Max.X -= 1
+            trimmed = true
+        }
+    }
+    return rect
+}
+
+type colorCount struct {
+    ColorCount
+    At image.Point
+}
+
+func countColors(img image.Image) []colorCount {
+    bounds := img.Bounds()
+    counts := map[color.RGBA]*colorCount{}
+    for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+        for x := bounds.Min.X; x < bounds.Max.X; x++ {
+            r, g, b, a := img.At(x, y).RGBA()
+            key := color.RGBA{R: uint8(r >> 8), G: uint8(g >> 8), B: uint8(b >> 8), A: uint8(a >> 8)}
+            if count, ok := counts[key]; ok {
+                count.Count += 1
+            } else {
+                counts[key] = &colorCount{ColorCount: ColorCount{Color: key, Count: 1}, At: image.Point{X: x, Y: y}}
+            }
+        }
+    }
+    result := []colorCount{}
+    for _, count := range counts {
+        result = append(result, *count)
+    }
+    sort.Slice(result, func(i, j int) bool {
+        if result[i].Count == result[j].Count {
+            return result[i].At.Y < result[j].At.Y || (result[i].At.Y == result[j].At.Y && result[i].At.X < result[j].At.X)
+        }
+        return result[i].Count > result[j].Count
+    })
+    return result
+}
+
+type subImage struct {
+    img image.Image
+    rect image.Rectangle
+}
+func (s subImage) At(x int, y int) color.Color {
+    return s.img.At(x, y)
+}
+func (s subImage) Bounds() image.Rectangle {
+    return s.rect
+}
+func (s subImage) ColorModel() color.Model {
+    return s.img.ColorModel()
+}
@@ -0,0 +1,104 @@
+package piet
+
+import (
+    "image"
+    "image/color"
+    "image/draw"
+    "testing"
+)
+
+func TestNormalize(t *testing.T) {
+    src, err := ReadImage("../examples/Piet_Hello_World.gif")
+    if err != nil {
+        t.Fatal(err)
+    }
+    expected := Tokenize(NewCodelImage(src, 11))
+    scaled, err := PietImageFromTokens(expected).Scale(3)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    // draw the program with slightly off colors inside a near black frame
+    const border = 2
+    bounds := scaled.Bounds()
+    drawn := image.NewRGBA(image.Rect(0, 0, bounds.Dx() + 2 * border, bounds.Dy() + 2 * border))
+    frame := color.RGBA{R:0x10, G:0x10, B:0x10, A:high}
+    draw.Draw(drawn, drawn.Bounds(), image.NewUniform(frame), image.Point{}, draw.Src)
+    draw.Draw(drawn, bounds.Add(image.Point{X:border, Y:border}), scaled, image.Point{}, draw.Src)
+    noisy := 0
+    for y := border; y < bounds.Dy() + border; y += 2 {
+        for x := border; x < bounds.Dx() + border; x += 5 {
+            c := drawn.RGBAAt(x, y)
+            if c.R > 0x10 {
+                c.R -= 0x0C
+            } else {
+                c.R += 0x0C
+            }
+            drawn.SetRGBA(x, y, c)
+            noisy += 1
+        }
+    }
+
+    pietImage, report, err := Normalize(drawn, UnknownNearest, 0)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if report.CodelSize != 3 {
+        t.Errorf("Expected codel size 3, got %d", report.CodelSize)
+    }
+    if report.Trimmed != bounds.Add(image.Point{X:border, Y:border}) {
+        t.Errorf("Expected the frame to be dropped, kept %v", report.Trimmed)
+    }
+    changed := 0
+    total := 0
+    for _, c := range report.Colors {
+        total += c.Count
+        if c.Changed() {
+            changed += c.Count
+        }
+        if c.Color == frame && c.Col != Black {
+            t.Errorf("Expected the frame to snap to black, got %s", c.Col)
+        }
+    }
+    if total != drawn.Bounds().Dx() * drawn.Bounds().Dy() {
+        t.Errorf("Expected %d pixels in the report, got %d", drawn.Bounds().Dx() * drawn.Bounds().Dy(), total)
+    }
+    frameSize := drawn.Bounds().Dx() * drawn.Bounds().Dy() - bounds.Dx() * bounds.Dy()
+    if changed != noisy + frameSize {
+        t.Errorf("Expected %d changed pixels, got %d", noisy + frameSize, changed)
+    }
+    tokensEqual(t, "normalized", expected, Tokenize(pietImage))
+}
+
+func TestNormalizeKeepsColorBorder(t *testing.T) {
+    tImg := NewTestImage(4, 4)
+    tImg.SetRect(tImg.Bounds(), colToColor[MediumRed])
+    tImg.SetRect(image.Rect(1, 1, 3, 3), colToColor[DarkBlue])
+
+    pietImage, report, err := Normalize(tImg, UnknownNearest, 1)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if report.Trimmed != tImg.Bounds() {
+        t.Errorf("A color block border should not be dropped, kept %v", report.Trimmed)
+    }
+    if pietImage.Width() != 4 || pietImage.Height() != 4 {
+        t.Errorf("Expected a 4x4 image, got %dx%d", pietImage.Width(), pietImage.Height())
+    }
+}
+
+func TestNormalizeKeepsWhiteBorder(t *testing.T) {
+    // the pointer can slide out of the program into a white frame, dropping
+    // it would change what the program does
+    tImg := NewTestImage(4, 3)
+    tImg.SetRect(tImg.Bounds(), colToColor[White])
+    tImg.SetRect(image.Rect(1, 1, 3, 2), colToColor[LightGreen])
+
+    _, report, err := Normalize(tImg, UnknownNearest, 1)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if report.Trimmed != tImg.Bounds() {
+        t.Errorf("A white border should not be dropped, kept %v", report.Trimmed)
+    }
+}
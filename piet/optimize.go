@@ -0,0 +1,174 @@
+package piet
+
+// constant is a value the optimizer knows is on top of the stack, pushed by
+// call.
+type constant struct {
+    val int32
+    call Call
+}
+
+// optimizer rewrites a trace, holding back the constants it knows about
+// until an op needs them at runtime.
+type optimizer struct {
+    level int
+    out StmtBlock
+    pending []constant
+    // rotation and toggle are the pointer and switch calls held back, they
+    // only change the pointer so they can be applied together.
+    rotation int32
+    toggle bool
+}
+
+// Optimize rewrites the trace from ParseStmt so it runs fewer calls with the
+// same output. Level 0 leaves it alone. Level 1 folds arithmetic on pushed
+// constants, cancels pushes that are popped again and turns pointer and
+// switch calls on constants into rotations, dropping the ones that don't turn
+// the pointer. Level 2 also merges pushes into a single call with several
+// Args.
+//
+// Ops that fail or are ignored in strict mode are never folded so strict runs
+// stop at the same op. Fewer values may be on the stack at once, so a
+// program can run without the stack overflow the unoptimized trace hits.
+func Optimize(block StmtBlock, level int) StmtBlock {
+    if level <= 0 {
+        return block
+    }
+    o := optimizer{level: level}
+    o.block(block)
+    o.flush()
+    return o.out
+}
+
+func (o *optimizer) block(block StmtBlock) {
+    for _, stmt := range block.Children {
+        if call, ok := stmt.(Call); ok {
+            o.call(call)
+        } else if child, ok := stmt.(StmtBlock); ok {
+            o.block(child)
+        } else {
+            o.emit(stmt)
+        }
+    }
+}
+
+// emit writes stmt after everything held back.
+func (o *optimizer) emit(stmt Stmt) {
+    o.flush()
+    o.out.Append(stmt)
+}
+
+func (o *optimizer) flush() {
+    if o.rotation != 0 {
+        o.out.Append(Call{Op: Pointer, Args: []int32{o.rotation}})
+        o.rotation = 0
+    }
+    if o.toggle {
+        o.out.Append(Call{Op: Switch, Args: []int32{1}})
+        o.toggle = false
+    }
+    if len(o.pending) == 0 {
+        return
+    }
+    if o.level < 2 {
+        for _, c := range o.pending {
+            push := c.call
+            push.Op = Push
+            push.Args = []int32{c.val}
+            o.out.Append(push)
+        }
+    } else {
+        push := o.pending[0].call
+        push.Op = Push
+        push.Args = make([]int32, len(o.pending))
+        for i, c := range o.pending {
+            push.Args[i] = c.val
+        }
+        o.out.Append(push)
+    }
+    o.pending = o.pending[:0]
+}
+
+func (o *optimizer) push(val int32, call Call) {
+    o.pending = append(o.pending, constant{val, call})
+}
+
+// pop2 removes the top two constants, false if there aren't two.
+func (o *optimizer) pop2() (int32, int32, bool) {
+    n := len(o.pending)
+    if n < 2 {
+        return 0, 0, false
+    }
+    f, s := o.pending[n - 1].val, o.pending[n - 2].val
+    o.pending = o.pending[:n - 2]
+    return f, s, true
+}
+
+func (o *optimizer) call(call Call) {
+    n := len(o.pending)
+    switch {
+    case call.Op == Push:
+        for _, arg := range call.Args {
+            o.push(arg, call)
+        }
+    case (call.Op == Pointer || call.Op == Switch) && len(call.Args) > 0:
+        o.turn(call.Op, call.Args[0])
+    case (call.Op == Pointer || call.Op == Switch || call.Op == Pop) && n > 0:
+        val := o.pending[n - 1].val
+        o.pending = o.pending[:n - 1]
+        if call.Op != Pop {
+            o.turn(call.Op, val)
+        }
+    case call.Op == Dup && n > 0:
+        o.push(o.pending[n - 1].val, call)
+    case call.Op == Not && n > 0:
+        o.pending[n - 1].call = call
+        if o.pending[n - 1].val == 0 {
+            o.pending[n - 1].val = 1
+        } else {
+            o.pending[n - 1].val = 0
+        }
+    case (call.Op == Add || call.Op == Sub || call.Op == Mult || call.Op == Greater) && n > 1:
+        f, s, _ := o.pop2()
+        switch call.Op {
+        case Add:
+            o.push(s + f, call)
+        case Sub:
+            o.push(s - f, call)
+        case Mult:
+            o.push(s * f, call)
+        default:
+            if s > f {
+                o.push(1, call)
+            } else {
+                o.push(0, call)
+            }
+        }
+    case (call.Op == Div || call.Op == Mod) && n > 1 && o.pending[n - 1].val != 0:
+        f, s, _ := o.pop2()
+        if call.Op == Div {
+            o.push(FloorDiv(s, f), call)
+        } else {
+            o.push(FloorMod(s, f), call)
+        }
+    case call.Op == Roll && n > 1 && o.pending[n - 2].val >= 0 && int(o.pending[n - 2].val) <= n - 2:
+        rolls, depth, _ := o.pop2()
+        if depth > 0 {
+            rolled := o.pending[len(o.pending) - int(depth):]
+            by := int(FloorMod(rolls, depth))
+            rotated := append(append([]constant{}, rolled[len(rolled) - by:]...), rolled[:len(rolled) - by]...)
+            copy(rolled, rotated)
+        }
+    default:
+        o.emit(call)
+    }
+}
+
+// turn holds back turning the pointer by val, like a pointer or switch call
+// with val as its argument.
+func (o *optimizer) turn(op Op, val int32) {
+    if op == Pointer {
+        o.rotation = FloorMod(o.rotation + FloorMod(val, 4), 4)
+    } else if val % 2 > 0 {
+        o.toggle = !o.toggle
+    }
+}
@@ -0,0 +1,151 @@
+package piet
+
+import (
+    "context"
+    "fmt"
+    "image"
+    "math/rand"
+    "strings"
+    "testing"
+)
+
+func calls(ops ...Call) StmtBlock {
+    block := StmtBlock{}
+    for _, call := range ops {
+        block.Append(call)
+    }
+    return block
+}
+
+func push(vals ...int32) Call {
+    return Call{Op: Push, Args: vals}
+}
+
+func describeCalls(block StmtBlock) string {
+    descriptions := []string{}
+    for _, stmt := range block.Children {
+        call := stmt.(Call)
+        if len(call.Args) > 0 {
+            descriptions = append(descriptions, fmt.Sprintf("%s %v", call.Op, call.Args))
+        } else {
+            descriptions = append(descriptions, call.Op.String())
+        }
+    }
+    return strings.Join(descriptions, "; ")
+}
+
+func TestOptimize(t *testing.T) {
+    cases := []struct {
+        name string
+        level int
+        block StmtBlock
+        expected string
+    }{
+        {"off", 0, calls(push(2), push(3), Call{Op: Add}), "push [2]; push [3]; add"},
+        {"arithmetic", 1, calls(push(2), push(3), Call{Op: Add}, push(4), Call{Op: Mult}, Call{Op: NumOut}), "push [20]; num_out"},
+        {"floored", 1, calls(push(7), push(2), Call{Op: Sub}, push(3), Call{Op: Mod}, push(4), push(5), Call{Op: Greater}, Call{Op: Not}), "push [2]; push [1]"},
+        {"push pop", 1, calls(push(1), Call{Op: Pop}, Call{Op: Exit}), "exit"},
+        {"dup", 1, calls(push(3), Call{Op: Dup}, Call{Op: Mult}, Call{Op: CharOut}), "push [9]; char_out"},
+        {"roll", 2, calls(push(1, 2, 3), push(3), push(1), Call{Op: Roll}, Call{Op: NumOut}), "push [3 1 2]; num_out"},
+        {"no-op turns", 1, calls(push(1), Call{Op: Dup}, Call{Op: Switch}, Call{Op: Switch}, push(4), Call{Op: Pointer}, Call{Op: Exit}), "exit"},
+        {"turns", 1, calls(push(-1), Call{Op: Pointer}, Call{Op: Pointer, Args: []int32{1}}, Call{Op: Switch, Args: []int32{1}}, Call{Op: Exit}), "switch [1]; exit"},
+        {"pointer", 1, calls(push(1), Call{Op: Pointer}, Call{Op: NumIn}), "pointer [1]; num_in"},
+        {"merge", 2, calls(push(1), push(2), Call{Op: NumIn}, push(3), Call{Op: Add}), "push [1 2]; num_in; push [3]; add"},
+        {"unknown operands", 1, calls(Call{Op: NumIn}, push(2), Call{Op: Mult}), "num_in; push [2]; mult"},
+        {"division by zero", 1, calls(push(4), push(0), Call{Op: Div}), "push [4]; push [0]; div"},
+        {"deep roll", 1, calls(push(2), push(1), Call{Op: Roll}), "push [2]; push [1]; roll"},
+    }
+    for _, c := range cases {
+        if got := describeCalls(Optimize(c.block, c.level)); got != c.expected {
+            t.Errorf("%s: expected %s got %s", c.name, c.expected, got)
+        }
+    }
+}
+
+func TestOptimizeStrict(t *testing.T) {
+    blocks := []StmtBlock{
+        calls(push(1), Call{Op: Add}),
+        calls(push(3), push(4), Call{Op: Add}, push(0), Call{Op: Div}),
+        calls(push(3), push(-1), push(1), Call{Op: Roll}),
+        calls(push(5), push(1), Call{Op: Roll}),
+    }
+    for _, block := range blocks {
+        failing := block.Children[len(block.Children) - 1].(Call)
+        failing.Pos = image.Point{X: 3, Y: 4}
+        block.Children[len(block.Children) - 1] = failing
+        expected := NewInterpreter(16)
+        expected.Strict = true
+        _, expectedErr := expected.Interpret(block)
+        for level := 1; level <= 2; level++ {
+            interpreter := NewInterpreter(16)
+            interpreter.Strict = true
+            _, err := interpreter.Interpret(Optimize(block, level))
+            if err == nil || expectedErr == nil || err.Error() != expectedErr.Error() {
+                t.Errorf("%s at level %d: expected %v got %v", describeCalls(block), level, expectedErr, err)
+            }
+        }
+    }
+}
+
+func TestOptimizeOutputUnchanged(t *testing.T) {
+    programs := []*Program{}
+    for _, c := range []struct {
+        filename string
+        codelSize int
+    }{
+        {"../examples/Piet_Hello_World.gif", 11},
+        {"../examples/nhello-big.gif", 4},
+        {"../examples/tetris.gif", 0},
+    } {
+        img, err := ReadImage(c.filename)
+        if err != nil {
+            t.Fatal(err)
+        }
+        prog, err := Load(img, c.codelSize)
+        if err != nil {
+            t.Fatal(err)
+        }
+        programs = append(programs, prog)
+    }
+    r := rand.New(rand.NewSource(5))
+    for i := 0; i < 100; i++ {
+        g, err := Generate(r, GenerateOptions{Ops: r.Intn(60), MaxPush: 4})
+        if err != nil {
+            t.Fatal(err)
+        }
+        prog, err := Load(g.Image, 1)
+        if err != nil {
+            t.Fatal(err)
+        }
+        programs = append(programs, prog)
+    }
+
+    for i, prog := range programs {
+        var expected strings.Builder
+        reference, err := Run(context.Background(), prog, strings.NewReader("12 x"), &expected, Options{})
+        if err != nil {
+            t.Fatal(err)
+        }
+        for level := 1; level <= 2; level++ {
+            var output strings.Builder
+            result, err := Run(context.Background(), prog, strings.NewReader("12 x"), &output, Options{Optimize: level})
+            if err != nil {
+                t.Errorf("program %d at level %d: %s", i, level, err)
+            }
+            if output.String() != expected.String() {
+                t.Errorf("program %d at level %d: expected %q got %q", i, level, expected.String(), output.String())
+            }
+            if result.Steps > reference.Steps {
+                t.Errorf("program %d at level %d: expected at most %d steps got %d", i, level, reference.Steps, result.Steps)
+            }
+        }
+    }
+}
+
+func TestCompileMergedPush(t *testing.T) {
+    var asm strings.Builder
+    CompileTmpl(calls(push(1, 2, 3)), &asm, EncodingUTF8)
+    if !strings.Contains(asm.String(), "Push 1\n    Push 2\n    Push 3\n") {
+        t.Errorf("Expected a Push for every argument")
+    }
+}
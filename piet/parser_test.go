@@ -1,4 +1,4 @@
-package main
+package piet
 
 import (
 	"fmt"
@@ -35,3 +35,23 @@ func TestParsing(t *testing.T) {
         }
     }
 }
+
+func TestDpRotate(t *testing.T) {
+    cases := []struct {
+        dp Dp
+        times int32
+        expected Dp
+    }{
+        {DpRight, 1, DpDown},
+        {DpUp, 1, DpRight},
+        {DpRight, -1, DpUp},
+        {DpDown, -6, DpUp},
+        {DpLeft, 2147483647, DpDown},
+        {DpLeft, -2147483648, DpLeft},
+    }
+    for _, c := range cases {
+        if got := c.dp.Rotate(c.times); got != c.expected {
+            t.Errorf("Expected %s rotated %d times to be %s got %s", c.dp, c.times, c.expected, got)
+        }
+    }
+}
@@ -0,0 +1,2077 @@
+package piet
+
+import (
+    "context"
+    "errors"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+    "embed"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+    "text/template"
+    "bufio"
+)
+
+// templates/macho64/main.tmpl
+
+const (
+    layoutsDir = "templates/layouts"
+    templatesDir = "templates"
+)
+
+var (
+    //go:embed templates/macho64/main.tmpl
+    asmTemplateFS embed.FS
+
+//    mainTmpl embed.FS
+    asmTemplate *template.Template
+)
+
+func init() {
+    asmTemplate = template.Must(template.New("main.tmpl").Funcs(template.FuncMap{
+          "IsBlock": func(stmt Stmt) bool {
+              _, ok := stmt.(StmtBlock) 
+              return ok
+          },
+          "IsCall": func(stmt Stmt) bool {
+              _, ok := stmt.(Call)
+              return ok
+          },
+          "IsOp": func(stmt Stmt, op string) bool {
+              if _, ok := stmt.(Call); ok {
+                  return (stmt.(Call)).Op.String() == op
+              }
+              return false
+          },
+          "IsTrap": func(stmt Stmt) bool {
+              _, ok := stmt.(Trap)
+              return ok
+          },
+          "HasArgs": func(stmt Stmt) bool {
+              if _, ok := stmt.(Call); ok {
+                  return len((stmt.(Call)).Args) > 0
+              }
+              return false
+          },
+      }).ParseFS(asmTemplateFS, "templates/macho64/main.tmpl"))//, "templates/macho64/stmt.tmpl"))
+  //    baseLayout := template.Must(template.New("layout").ParseFS(mainTmpl, templateLayout))
+}
+
+type CodelSampling byte
+const (
+    SampleTopLeft CodelSampling = 0
+    SampleStrict CodelSampling = 1
+    SampleMajority CodelSampling = 2
+)
+func (c CodelSampling) String() string {
+    switch c {
+    case SampleTopLeft:
+        return "topleft"
+    case SampleStrict:
+        return "strict"
+    case SampleMajority:
+        return "majority"
+    default:
+        return "unknown"
+    }
+}
+func ParseCodelSampling(name string) (CodelSampling, error) {
+    for sampling := SampleTopLeft; sampling <= SampleMajority; sampling++ {
+        if sampling.String() == name {
+            return sampling, nil
+        }
+    }
+    return SampleTopLeft, fmt.Errorf("unrecognized codel sampling %s, expected one of (topleft, strict, majority)", name)
+}
+
+type CodelMismatchError struct {
+    Size int
+    Codels []image.Point
+}
+func (e CodelMismatchError) Error() string {
+    points := []string{}
+    for i, p := range e.Codels {
+        if i == 10 {
+            points = append(points, "...")
+            break
+        }
+        points = append(points, fmt.Sprintf("(%d, %d)", p.X, p.Y))
+    }
+    return fmt.Sprintf("%d codels of size %d contain more than one color: %s", len(e.Codels), e.Size, strings.Join(points, ", "))
+}
+
+// CodelImage scales an image down so that every codel becomes one pixel.
+// Codels are laid out from the image's Min corner, a partial codel along the
+// right or bottom edge still counts as a codel.
+type CodelImage struct {
+    img image.Image
+    csize int
+    bounds image.Rectangle
+    sampling CodelSampling
+}
+func NewCodelImage(img image.Image, codelSize int) *CodelImage {
+    size := img.Bounds().Size()
+    rect := image.Rectangle{
+        Max: image.Point{
+            X: (size.X + codelSize - 1) / codelSize,
+            Y: (size.Y + codelSize - 1) / codelSize,
+        },
+    }
+    return &CodelImage{
+        img: img,
+        csize: codelSize,
+        bounds: rect,
+    }
+}
+// NewSampledCodelImage creates a CodelImage that reads each codel using the
+// given sampling. Strict sampling fails when any codel holds more than one color.
+func NewSampledCodelImage(img image.Image, codelSize int, sampling CodelSampling) (*CodelImage, error) {
+    if sampling == SampleStrict {
+        if mismatches := CodelMismatches(img, codelSize); len(mismatches) > 0 {
+            return nil, CodelMismatchError{Size: codelSize, Codels: mismatches}
+        }
+    }
+    codelImg := NewCodelImage(img, codelSize)
+    codelImg.sampling = sampling
+    return codelImg, nil
+}
+func (c CodelImage) At(x int, y int) color.Color {
+    min := c.img.Bounds().Min
+    if c.sampling != SampleMajority {
+        return c.img.At(min.X + x * c.csize, min.Y + y * c.csize)
+    }
+    codel := image.Rect(x * c.csize, y * c.csize, (x + 1) * c.csize, (y + 1) * c.csize).Add(min).Intersect(c.img.Bounds())
+    return majorityColor(c.img, codel)
+}
+func (c CodelImage) Bounds() image.Rectangle {
+    return c.bounds;
+}
+func (c CodelImage) ColorModel() color.Model {
+    return c.img.ColorModel()
+}
+
+func majorityColor(img image.Image, rect image.Rectangle) color.Color {
+    counts := map[Col]int{}
+    colors := map[Col]color.Color{}
+    var best color.Color
+    bestCount := 0
+    for y := rect.Min.Y; y < rect.Max.Y; y++ {
+        for x := rect.Min.X; x < rect.Max.X; x++ {
+            c := img.At(x, y)
+            col := ColorToCol(c)
+            if _, ok := colors[col]; !ok {
+                colors[col] = c
+            }
+            counts[col] += 1
+            if counts[col] > bestCount {
+                best = colors[col]
+                bestCount = counts[col]
+            }
+        }
+    }
+    return best
+}
+
+// DetectCodelSize finds the largest codel size that evenly divides the length
+// of every horizontal and vertical run of a single color in img.
+func DetectCodelSize(img image.Image) int {
+    bounds := img.Bounds()
+    size := 0
+    for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+        run := 1
+        for x := bounds.Min.X + 1; x < bounds.Max.X; x++ {
+            if sameColor(img.At(x, y), img.At(x - 1, y)) {
+                run += 1
+                continue
+            }
+            size = gcd(size, run)
+            run = 1
+        }
+        size = gcd(size, run)
+        if size == 1 {
+            return 1
+        }
+    }
+    for x := bounds.Min.X; x < bounds.Max.X; x++ {
+        run := 1
+        for y := bounds.Min.Y + 1; y < bounds.Max.Y; y++ {
+            if sameColor(img.At(x, y), img.At(x, y - 1)) {
+                run += 1
+                continue
+            }
+            size = gcd(size, run)
+            run = 1
+        }
+        size = gcd(size, run)
+        if size == 1 {
+            return 1
+        }
+    }
+    if size == 0 {
+        return 1
+    }
+    return size
+}
+
+// CodelMismatches returns the top-left pixel of every codel of the given size
+// whose pixels are not all the same Piet color.
+func CodelMismatches(img image.Image, codelSize int) []image.Point {
+    bounds := img.Bounds()
+    mismatches := []image.Point{}
+    for cy := bounds.Min.Y; cy < bounds.Max.Y; cy += codelSize {
+        for cx := bounds.Min.X; cx < bounds.Max.X; cx += codelSize {
+            codel := image.Rect(cx, cy, cx + codelSize, cy + codelSize).Intersect(bounds)
+            if !uniform(img, codel) {
+                mismatches = append(mismatches, codel.Min)
+            }
+        }
+    }
+    return mismatches
+}
+
+func uniform(img image.Image, rect image.Rectangle) bool {
+    first := ColorToCol(img.At(rect.Min.X, rect.Min.Y))
+    for y := rect.Min.Y; y < rect.Max.Y; y++ {
+        for x := rect.Min.X; x < rect.Max.X; x++ {
+            if first != ColorToCol(img.At(x, y)) {
+                return false
+            }
+        }
+    }
+    return true
+}
+
+func sameColor(f color.Color, s color.Color) bool {
+    fr, fg, fb, fa := f.RGBA()
+    sr, sg, sb, sa := s.RGBA()
+    return fr == sr && fg == sg && fb == sb && fa == sa
+}
+
+func gcd(a int, b int) int {
+    for b != 0 {
+        a, b = b, a % b
+    }
+    return a
+}
+
+func ParseCodelSize(value string) (int, error) {
+    if value == "auto" {
+        return 0, nil
+    }
+    size, err := strconv.Atoi(value)
+    if err != nil || size < 1 {
+        return 0, fmt.Errorf("invalid codel size %s, expected a positive integer or auto", value)
+    }
+    return size, nil
+}
+
+type Dp byte
+const (
+    DpRight Dp = 0
+    DpDown Dp = 1
+    DpLeft Dp = 2
+    DpUp Dp = 3
+)
+func (d Dp) String() string {
+    switch d {
+    case DpRight:
+        return "right"
+    case DpLeft:
+        return "left"
+    case DpUp:
+        return "up"
+    case DpDown:
+        return "down"
+    default:
+        return "unknown"
+    }
+}
+// Rotate turns the pointer clockwise, or anticlockwise when times is
+// negative.
+func (d Dp) Rotate(times int32) Dp {
+    return Dp((int32(d) + FloorMod(times, 4)) % 4)
+}
+
+type Cc byte
+const (
+    CcLeft Cc = 0
+    CcRight Cc = 1
+)
+func (c Cc) String() string {
+    if c == CcLeft {
+        return "left"
+    } else if c == CcRight {
+        return "right"
+    } else {
+        return "unknown"
+    }
+}
+func (c Cc) Toggle() Cc {
+    if c == CcLeft {
+        return CcRight
+    }
+    return CcLeft
+}
+
+type Op byte
+const (
+    Push Op = 1
+    Pop Op = 2
+    Add Op = 3
+    Sub Op = 4
+    Mult Op = 5
+    Div Op = 6
+    Mod Op = 7
+    Not Op = 8
+    Greater Op = 9
+    Pointer Op = 10
+    Switch Op = 11
+    Dup Op = 12
+    Roll Op = 13
+    NumIn Op = 14
+    CharIn Op = 15
+    NumOut Op = 16
+    CharOut Op = 17
+    Goto Op = 18
+    Noop = 19
+    Exit Op = 20
+)
+func (o Op) String() string {
+    switch o {
+    case Pop:
+        return "pop"
+    case Push:
+        return "push"
+    case Noop:
+        return "noop"
+    case Exit: 
+        return "exit"
+    case Add:
+        return "add"
+    case Sub:
+        return "sub"
+    case Mult:
+        return "mult"
+    case Div:
+        return "div"
+    case Mod:
+        return "mod"
+    case Not:
+        return "not"
+    case Greater:
+        return "greater"
+    case Pointer:
+        return "pointer"
+    case Switch:
+        return "switch"
+    case Dup:
+        return "dup"
+    case Roll:
+        return "roll"
+    case NumIn:
+        return "num_in"
+    case CharIn:
+        return "char_in"
+    case CharOut:
+        return "char_out"
+    case NumOut:
+        return "num_out"
+    default:
+        return fmt.Sprintf("Unknown operator %d", byte(o))
+    }
+}
+
+type Col byte 
+const (
+    LightRed Col = 0
+    MediumRed Col = 1
+    DarkRed Col = 2
+    LightYellow Col = 3
+    MediumYellow Col = 4
+    DarkYellow Col = 5
+    LightGreen Col = 6
+    MediumGreen Col = 7 
+    DarkGreen Col = 8
+    LightCyan Col = 9
+    MediumCyan Col = 10
+    DarkCyan Col = 11
+    LightBlue Col = 12
+    MediumBlue Col = 13
+    DarkBlue Col = 14
+    LightMagenta Col = 15
+    MediumMagenta Col = 16
+    DarkMagenta Col = 17
+    White Col = 18
+    Black Col = 19
+    Unrecoganized Col = 20
+)
+func (c Col) String() string {
+    names := []string{"light", "medium", "dark"}
+    hues := []string{"red", "yellow", "green", "cyan", "blue", "magenta"}
+    switch {
+    case c == White:
+        return "white"
+    case c == Black:
+        return "black"
+    case c < White:
+        return names[int(c) % 3] + " " + hues[int(c) / 3]
+    default:
+        return "unrecognized"
+    }
+}
+func (c Col) ToOp(o Col) Op {
+    if c == Black || o == Black || c == White || o == White || c == Unrecoganized || o == Unrecoganized {
+        return Noop
+    }
+    c_hue := int(c) / 3
+    o_hue := int(o) / 3
+    hue_diff := DiffAndWrap(c_hue, o_hue, 6)
+
+    c_light := int(c) % 3
+    o_light := int(o) % 3
+    light_diff := DiffAndWrap(c_light, o_light, 3)
+
+    return Op(hue_diff * 3 + light_diff)
+}
+// Next is the color that performs op when the pointer moves to it from c,
+// the inverse of ToOp. op must be one of the ops a color change performs.
+func (c Col) Next(op Op) Col {
+    hue := (int(c) / 3 + int(op) / 3) % 6
+    light := (int(c) % 3 + int(op) % 3) % 3
+    return Col(hue * 3 + light)
+}
+
+// FloorDiv divides s by f rounding towards negative infinity, so that
+// s == FloorDiv(s, f) * f + FloorMod(s, f). f must not be 0.
+func FloorDiv(s int32, f int32) int32 {
+    q := s / f
+    if s % f != 0 && (s < 0) != (f < 0) {
+        q -= 1
+    }
+    return q
+}
+
+// FloorMod returns s modulo f with the sign of the divisor f, as the spec
+// requires. f must not be 0.
+func FloorMod(s int32, f int32) int32 {
+    r := s % f
+    if r != 0 && (r < 0) != (f < 0) {
+        r += f
+    }
+    return r
+}
+
+func DiffAndWrap(f int, s int, max int) int {
+    if s >= f {
+        return s - f
+    }
+    return s + max - f
+}
+
+// ColorToCol looks up the Piet color of c. Every color is normalized to 8-bit
+// RGBA first so the match does not depend on the image's color model.
+func ColorToCol(c color.Color) Col {
+    r, g, b, a := c.RGBA()
+    key := color.RGBA{R: uint8(r >> 8), G: uint8(g >> 8), B: uint8(b >> 8), A: uint8(a >> 8)}
+    if col, ok := colorToCol[key]; ok {
+        return col
+    }
+    return Unrecoganized
+}
+
+const zero uint8 = 0x00
+const mid uint8 = 0xC0
+const high uint8 = 0xFF
+var colorToCol = map[color.RGBA]Col {
+    color.RGBA{A:high}: Black,
+    color.RGBA{A:high, R: high, G: high, B: high}: White,
+
+    color.RGBA{A:high, R:high, G:mid, B:mid}: LightRed,
+    color.RGBA{A:high, R:high}:                 MediumRed,
+    color.RGBA{A:high, R:mid}:                  DarkRed,
+
+    color.RGBA{A:high, G:high, B:mid, R:mid}: LightGreen,
+    color.RGBA{A:high, G:high}:                 MediumGreen,
+    color.RGBA{A:high, G:mid}:                  DarkGreen,
+
+    color.RGBA{A:high, B:high, R:mid, G:mid}: LightBlue,
+    color.RGBA{A:high, B:high}:                 MediumBlue,
+    color.RGBA{A:high, B:mid}:                  DarkBlue,
+
+    color.RGBA{A:high, R:high, G:mid, B:high}:LightMagenta,
+    color.RGBA{A:high, R:high, B:high}:        MediumMagenta,
+    color.RGBA{A:high, R:mid, B:mid}:          DarkMagenta,
+
+    color.RGBA{A:high, R:high, G:high, B:mid}:LightYellow,
+    color.RGBA{A:high, R:high, G:high}:        MediumYellow,
+    color.RGBA{A:high, R:mid, G:mid}:          DarkYellow,
+
+    color.RGBA{A:high, R:mid, G:high, B:high}:LightCyan,
+    color.RGBA{A:high, G:high, B:high}:        MediumCyan,
+    color.RGBA{A:high, G:mid, B:mid}:          DarkCyan,
+}
+
+var pietPalette = color.Palette{
+    LightRed:      color.RGBA{A:high, R:high, G:mid, B:mid},
+    MediumRed:     color.RGBA{A:high, R:high},
+    DarkRed:       color.RGBA{A:high, R:mid},
+    LightYellow:   color.RGBA{A:high, R:high, G:high, B:mid},
+    MediumYellow:  color.RGBA{A:high, R:high, G:high},
+    DarkYellow:    color.RGBA{A:high, R:mid, G:mid},
+    LightGreen:    color.RGBA{A:high, G:high, B:mid, R:mid},
+    MediumGreen:   color.RGBA{A:high, G:high},
+    DarkGreen:     color.RGBA{A:high, G:mid},
+    LightCyan:     color.RGBA{A:high, R:mid, G:high, B:high},
+    MediumCyan:    color.RGBA{A:high, G:high, B:high},
+    DarkCyan:      color.RGBA{A:high, G:mid, B:mid},
+    LightBlue:     color.RGBA{A:high, B:high, R:mid, G:mid},
+    MediumBlue:    color.RGBA{A:high, B:high},
+    DarkBlue:      color.RGBA{A:high, B:mid},
+    LightMagenta:  color.RGBA{A:high, R:high, G:mid, B:high},
+    MediumMagenta: color.RGBA{A:high, R:high, B:high},
+    DarkMagenta:   color.RGBA{A:high, R:mid, B:mid},
+    White:         color.RGBA{A:high, R: high, G: high, B: high},
+    Black:         color.RGBA{A:high},
+}
+
+func (c Col) Color() color.Color {
+    if int(c) < len(pietPalette) {
+        return pietPalette[c]
+    }
+    return color.Transparent
+}
+
+// NearestCol finds the palette color closest to c, measured either as the
+// euclidean distance between RGB components or in CIE L*a*b* space.
+func NearestCol(c color.Color, lab bool) Col {
+    best := White
+    bestDist := -1.0
+    for idx, pc := range pietPalette {
+        var dist float64
+        if lab {
+            dist = labDistance(c, pc)
+        } else {
+            dist = rgbDistance(c, pc)
+        }
+        if bestDist < 0 || dist < bestDist {
+            best = Col(idx)
+            bestDist = dist
+        }
+    }
+    return best
+}
+
+func rgbDistance(f color.Color, s color.Color) float64 {
+    fr, fg, fb, _ := f.RGBA()
+    sr, sg, sb, _ := s.RGBA()
+    dr := float64(fr >> 8) - float64(sr >> 8)
+    dg := float64(fg >> 8) - float64(sg >> 8)
+    db := float64(fb >> 8) - float64(sb >> 8)
+    return dr * dr + dg * dg + db * db
+}
+
+func labDistance(f color.Color, s color.Color) float64 {
+    fl, fa, fb := toLab(f)
+    sl, sa, sb := toLab(s)
+    return (fl - sl) * (fl - sl) + (fa - sa) * (fa - sa) + (fb - sb) * (fb - sb)
+}
+
+func toLab(c color.Color) (float64, float64, float64) {
+    r, g, b, _ := c.RGBA()
+    linear := func(v uint32) float64 {
+        f := float64(v) / 0xFFFF
+        if f <= 0.04045 {
+            return f / 12.92
+        }
+        return math.Pow((f + 0.055) / 1.055, 2.4)
+    }
+    lr, lg, lb := linear(r), linear(g), linear(b)
+
+    // sRGB -> XYZ relative to the D65 white point
+    x := (0.4124 * lr + 0.3576 * lg + 0.1805 * lb) / 0.95047
+    y := (0.2126 * lr + 0.7152 * lg + 0.0722 * lb) / 1.0
+    z := (0.0193 * lr + 0.1192 * lg + 0.9505 * lb) / 1.08883
+
+    f := func(t float64) float64 {
+        if t > 216.0 / 24389.0 {
+            return math.Cbrt(t)
+        }
+        return (24389.0 / 27.0 * t + 16) / 116
+    }
+    fx, fy, fz := f(x), f(y), f(z)
+    return 116 * fy - 16, 500 * (fx - fy), 200 * (fy - fz)
+}
+
+type UnknownColorPolicy byte
+const (
+    UnknownWhite UnknownColorPolicy = 0
+    UnknownBlack UnknownColorPolicy = 1
+    UnknownNearest UnknownColorPolicy = 2
+    UnknownNearestLab UnknownColorPolicy = 3
+    UnknownError UnknownColorPolicy = 4
+)
+func (u UnknownColorPolicy) String() string {
+    switch u {
+    case UnknownWhite:
+        return "white"
+    case UnknownBlack:
+        return "black"
+    case UnknownNearest:
+        return "nearest"
+    case UnknownNearestLab:
+        return "nearest-lab"
+    case UnknownError:
+        return "error"
+    default:
+        return "unknown"
+    }
+}
+func ParseUnknownColorPolicy(name string) (UnknownColorPolicy, error) {
+    for policy := UnknownWhite; policy <= UnknownError; policy++ {
+        if policy.String() == name {
+            return policy, nil
+        }
+    }
+    return UnknownWhite, fmt.Errorf("unrecognized color policy %s, expected one of (white, black, nearest, nearest-lab, error)", name)
+}
+
+type UnknownColorError struct {
+    X, Y int
+    Color color.Color
+}
+func (e UnknownColorError) Error() string {
+    r, g, b, _ := e.Color.RGBA()
+    return fmt.Sprintf("unrecognized color #%02x%02x%02x at (%d, %d)", r >> 8, g >> 8, b >> 8, e.X, e.Y)
+}
+
+// PolicyImage replaces every pixel that is not one of the 20 Piet colors
+// according to an UnknownColorPolicy, so the tokenizer never sees
+// Unrecoganized codels.
+type PolicyImage struct {
+    img image.Image
+    policy UnknownColorPolicy
+}
+func NewPolicyImage(img image.Image, policy UnknownColorPolicy) (*PolicyImage, error) {
+    if policy == UnknownError {
+        bounds := img.Bounds()
+        for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+            for x := bounds.Min.X; x < bounds.Max.X; x++ {
+                if c := img.At(x, y); ColorToCol(c) == Unrecoganized {
+                    return nil, UnknownColorError{X: x, Y: y, Color: c}
+                }
+            }
+        }
+    }
+    return &PolicyImage{img: img, policy: policy}, nil
+}
+func (p PolicyImage) At(x int, y int) color.Color {
+    c := p.img.At(x, y)
+    if ColorToCol(c) != Unrecoganized {
+        return c
+    }
+    switch p.policy {
+    case UnknownBlack:
+        return Black.Color()
+    case UnknownNearest:
+        return NearestCol(c, false).Color()
+    case UnknownNearestLab:
+        return NearestCol(c, true).Color()
+    default:
+        return White.Color()
+    }
+}
+func (p PolicyImage) Bounds() image.Rectangle {
+    return p.img.Bounds()
+}
+func (p PolicyImage) ColorModel() color.Model {
+    return p.img.ColorModel()
+}
+
+type PietTokens struct {
+    Bounds image.Rectangle
+    data [][]int
+    shapes []*Shape
+}
+func NewPietTokens(width int, height int) *PietTokens {
+    pietTokens := PietTokens{
+        Bounds: image.Rectangle{
+            Max: image.Point{X:width, Y:height},
+        },
+        data: make([][] int, width),
+        shapes: []*Shape{},
+    }
+    for x := 0; x < width; x++ {
+        pietTokens.data[x] = make([]int, height)
+        for y := 0; y < height; y++ {
+            pietTokens.data[x][y] = -1
+        }
+    }
+    return &pietTokens
+}
+func (p *PietTokens) Width() int {
+    return len(p.data)
+}
+func (p *PietTokens) Height() int {
+    return len(p.data[0])
+}
+func (p *PietTokens) Size() int {
+    return len(p.shapes)
+}
+func (p *PietTokens) At(x int, y int) *Shape {
+    if p.data == nil || x < 0 || y < 0 || x >= len(p.data) || p.data[x] == nil || y >= len(p.data[x]) {
+        return nil
+    }
+    if p.data[x][y] == -1 {
+        return nil
+    }
+    return p.shapes[p.data[x][y]]
+}
+func (p *PietTokens) Add(s *Shape) {
+    p.shapes = append(p.shapes, s)
+}
+func Tokenize(img image.Image) *PietTokens {
+    if img.Bounds().Min != (image.Point{}) {
+        img = NewCodelImage(img, 1)
+    }
+    pietTokens := NewPietTokens(img.Bounds().Max.X, img.Bounds().Max.Y)
+
+    pos := image.Point{X:0,Y:0}
+    for pos.X = 0; pos.X < img.Bounds().Max.X; pos.X++ {
+        for pos.Y = 0; pos.Y < img.Bounds().Max.Y; pos.Y++ {
+            if pietTokens.data[pos.X][pos.Y] == -1 {
+                shape := Shape{
+                    Color: ColorToCol(img.At(pos.X, pos.Y)),
+                }
+                shape.AddPoint(pos)
+                idx := len(pietTokens.shapes)
+                pietTokens.data[pos.X][pos.Y] = idx
+                pietTokens.Add(&shape)
+                fillLeft(img, pos, &shape, pietTokens)
+                fillRight(img, pos, &shape, pietTokens)
+                fillUp(img, pos, &shape, pietTokens)
+                fillDown(img, pos, &shape, pietTokens)
+            }         
+        }
+    }
+
+    return pietTokens
+}
+
+// TODO JH optimize this
+func fillLeft(img image.Image, pos image.Point, shape *Shape, pietTokens *PietTokens) {
+    pos.X -= 1
+    if !pos.In(img.Bounds()) {
+        return
+    }
+    if pietTokens.data[pos.X][pos.Y] != -1 {
+        return
+    }
+    colAtPos := ColorToCol(img.At(pos.X, pos.Y))
+    if shape.Color != colAtPos {
+        return
+    }                
+    pietTokens.data[pos.X][pos.Y] = len(pietTokens.shapes) - 1
+    shape.AddPoint(pos)
+    fillLeft(img, pos, shape, pietTokens)
+    fillUp(img, pos, shape, pietTokens)
+    fillDown(img, pos, shape, pietTokens)
+}
+func fillUp(img image.Image, pos image.Point, shape *Shape, pietTokens *PietTokens) {
+    pos.Y -= 1
+    if !pos.In(img.Bounds()) {
+        return
+    }
+    if pietTokens.data[pos.X][pos.Y] != -1 {
+        return
+    }
+    colAtPos := ColorToCol(img.At(pos.X, pos.Y))
+    if shape.Color != colAtPos {
+        return
+    }
+    pietTokens.data[pos.X][pos.Y] = len(pietTokens.shapes) - 1
+    shape.AddPoint(pos)
+    fillUp(img, pos, shape, pietTokens)
+    fillLeft(img, pos, shape, pietTokens)
+    fillRight(img, pos, shape, pietTokens)
+}
+func fillRight(img image.Image, pos image.Point, shape *Shape, pietTokens *PietTokens) {
+    pos.X += 1
+    if !pos.In(img.Bounds()) {
+        return
+    }
+    if pietTokens.data[pos.X][pos.Y] != -1 {
+        return
+    }
+    colAtPos := ColorToCol(img.At(pos.X, pos.Y))
+    if shape.Color != colAtPos {
+        return
+    }
+    pietTokens.data[pos.X][pos.Y] = len(pietTokens.shapes) - 1
+    shape.AddPoint(pos)
+    fillRight(img, pos, shape, pietTokens)
+    fillUp(img, pos, shape, pietTokens)
+    fillDown(img, pos, shape, pietTokens)
+}
+func fillDown(img image.Image, pos image.Point, shape *Shape, pietTokens *PietTokens) {
+    pos.Y += 1
+    if !pos.In(img.Bounds()) {
+        return
+    }
+    if pietTokens.data[pos.X][pos.Y] != -1 {
+        return
+    }
+    colAtPos := ColorToCol(img.At(pos.X, pos.Y))
+    if shape.Color != colAtPos {
+        return
+    }
+    pietTokens.data[pos.X][pos.Y] = len(pietTokens.shapes) - 1
+    shape.AddPoint(pos)
+    fillDown(img, pos, shape, pietTokens)
+    fillLeft(img, pos, shape, pietTokens)
+    fillRight(img, pos, shape, pietTokens)
+}
+
+type Shape struct {
+    Color Col
+    Size int32
+    xEdges *TreeNode
+    yEdges *TreeNode
+}
+func (s *Shape) AddPoint(p image.Point) {
+    s.Size += 1
+    if s.Size == 1 {
+        s.xEdges = NewTreeNode(p.X, p.Y)
+        s.yEdges = NewTreeNode(p.Y, p.X)
+    } else {
+        s.xEdges.Add(p.X, p.Y)
+        s.yEdges.Add(p.Y, p.X)
+    }
+}
+
+type Node struct {
+    x, y int
+}
+
+type Instr struct {
+    Op Op
+    Data uint32
+}
+// Stack grows as values are pushed, up to capacity values. A capacity of 0
+// means the stack can grow without limit.
+type Stack [C any] struct {
+    data []C
+    head int
+    capacity int
+}
+// initialStackSize is how many values a stack has room for before it first
+// grows.
+const initialStackSize = 64
+func NewIntStack(capacity int) *Stack [int32] {
+    size := initialStackSize
+    if capacity > 0 && capacity < size {
+        size = capacity
+    }
+    return &Stack [int32]{
+        data: make([]int32, 0, size),
+        head: -1,
+        capacity: capacity,
+    }
+}
+func NewStack(capacity int) *Stack [int32] {
+    return NewIntStack(capacity)
+}
+func (s Stack[C]) String() string {
+    result := fmt.Sprint("[")
+    for i := 0; i <= s.head; i++ {
+        if i > 0 {
+            result += fmt.Sprintf(", %v", s.data[i])
+        } else {
+            result += fmt.Sprint(s.data[i])
+        }
+    }
+    result += "]"
+    return result
+}
+func (s *Stack[C]) Len() int {
+    return s.head + 1
+}
+// Roll buries the top value depth deep, rolls times. A negative number of
+// rolls goes the other way. Rolling deeper than the stack or to a negative
+// depth is ignored and reported by returning false.
+func (s *Stack[C]) Roll(depth int32, rolls int32) bool {
+    if depth < 0 || int(depth) > s.Len() {
+        return false
+    }
+    if depth == 0 {
+        return true
+    }
+    rolls = FloorMod(rolls, depth)
+    min := s.Len() - int(depth)
+    mid := min + int(rolls)
+    s.Reverse(min, s.Len())
+    s.Reverse(min, mid)
+    s.Reverse(mid, s.Len())
+    return true
+}
+
+// Reverse reverses the values in [from, to).
+func (s *Stack[C]) Reverse(from int, to int) {
+    for i, j := from, to - 1; i < j; i, j = i + 1, j - 1 {
+        s.Swap(i, j)
+    }
+}
+
+func (s *Stack[C]) Swap(source int, target int) {
+    tmp := s.data[target]
+    s.data[target] = s.data[source]
+    s.data[source] = tmp
+}
+
+// Push returns false, leaving the stack alone, when the stack is full.
+func (s *Stack[C]) Push(val C) bool {
+    if s.capacity > 0 && s.head + 1 >= s.capacity {
+        return false
+    }
+    s.head += 1
+    if s.head < len(s.data) {
+        s.data[s.head] = val
+    } else {
+        s.data = append(s.data, val)
+    }
+    return true
+}
+func (s *Stack[C]) Pop() (C, bool) {
+    if s.head < 0 {
+        var result C
+        return result, false
+    }
+    val := s.data[s.head]
+    s.head -= 1
+    return val, true
+}
+func (s *Stack[C]) Pop2() (C, C, bool) {
+    if s.head < 1 {
+        var result C
+        return result, result, false
+    }
+    val := s.data[s.head]
+    val2 := s.data[s.head - 1]
+    s.head -= 2
+    return val, val2, true
+}
+func (s *Stack[C]) Peek() (C, bool) {
+    if s.head < 0 {
+        var result C
+        return result, false
+    }
+    return s.data[s.head], true
+}
+// Dup returns false when the stack is empty or full.
+func (s *Stack[C]) Dup() bool {
+    val, ok := s.Peek()
+    return ok && s.Push(val)
+}
+
+// ReadImage decodes a gif, png, jpeg, ppm or bmp file.
+func ReadImage(filename string) (image.Image, error) {
+    file, err := os.Open(filename)
+    if err != nil {
+        // FIXME proper error handling
+        return nil, err
+    }
+    defer file.Close()
+
+    image, _, err := image.Decode(file)
+    return image, err
+}
+
+// maxImagePixels is the largest image the bmp and ppm decoders accept, a
+// header can't make them allocate more than this.
+const maxImagePixels = 1 << 24
+
+// checkImageSize rejects dimensions from a header that would need more than
+// maxImagePixels pixels.
+func checkImageSize(format string, width int, height int) error {
+    if width < 0 || height < 0 {
+        return fmt.Errorf("%s: invalid dimensions %dx%d", format, width, height)
+    }
+    if width > 0 && height > maxImagePixels / width {
+        return fmt.Errorf("%s: %dx%d image is too large", format, width, height)
+    }
+    return nil
+}
+
+// readData reads exactly n bytes of pixel data. The buffer grows as the data
+// arrives so a short input never allocates all n.
+func readData(r io.Reader, n int) ([]byte, error) {
+    data, err := io.ReadAll(io.LimitReader(r, int64(n)))
+    if err != nil {
+        return nil, err
+    }
+    if len(data) < n {
+        return nil, io.ErrUnexpectedEOF
+    }
+    return data, nil
+}
+
+func InBounds(x int, y int, width int, height int) bool {
+    return x >= 0 && y >= 0 && x < width && y < height
+}
+
+type TreeNode struct {
+    Key int
+    Min int
+    Max int
+    Left *TreeNode
+    Right *TreeNode
+}
+func NewTreeNode(key int, val int) *TreeNode {
+    return &TreeNode{Key: key, Min: val, Max: val}
+}
+func (t *TreeNode) Get(key int) (*TreeNode, bool) {
+    if t.Key == key {
+        return t, true
+    } else if t.Key < key {
+        if t.Right == nil {
+            return nil, false
+        }
+        return t.Right.Get(key)
+    } else {
+        if t.Left == nil {
+            return nil, false
+        }
+        return t.Left.Get(key)
+    }
+}
+func (t *TreeNode) MinNode() (*TreeNode) {
+    if t.Left != nil {
+        return t.Left.MinNode()
+    }
+    return t
+}
+func (t *TreeNode) MaxNode() (*TreeNode) {
+    if t.Right != nil {
+        return t.Right.MaxNode()
+    }
+    return t
+}
+func (t *TreeNode) Add(key int, val int) {
+    if t.Key == key {
+        if t.Min > val {
+            t.Min = val
+        }
+        if t.Max < val {
+            t.Max = val
+        }
+    } else if t.Key < key {
+        if t.Right == nil {
+            t.Right = NewTreeNode(key, val)
+        } else {
+            t.Right.Add(key, val)
+        }
+    } else {
+        if t.Left == nil {
+            t.Left = NewTreeNode(key, val)
+        } else {
+            t.Left.Add(key, val)
+        }
+    }
+}
+
+func ParseStmt(tokens *PietTokens, capacity int) Stmt {
+    root, _ := ParseStmtWith(tokens, ParseOptions{Capacity: capacity})
+    return root
+}
+
+type ParseOptions struct {
+    Capacity int
+    // MaxCalls stops the trace once more calls than this have been
+    // produced, 0 means no limit.
+    MaxCalls int
+    // Strict ends the trace at the first op that would be ignored, that op
+    // is still emitted followed by a Trap.
+    Strict bool
+    // Context stops the trace once it is done, nil means no limit.
+    Context context.Context
+}
+
+// ParseStmtWith traces the program like ParseStmt. It returns false if the
+// trace was cut short by MaxCalls or the Context. A trace that stops at a
+// stack overflow or at an op Strict doesn't allow ends with a Trap.
+//
+// Input is read as -1, and at the end of the input nothing is pushed at all,
+// so once input has been read the trace's stack is only a guess. From then on
+// ops the trace can't perform are kept for the interpreter or the compiled
+// program to try, Strict and a full stack no longer end the trace, and the
+// pointer turns the way the guessed values say.
+func ParseStmtWith(tokens *PietTokens, opts ParseOptions) (StmtBlock, bool) {
+    walker := newWalker(tokens)
+
+    root := StmtBlock{}
+    stack := NewIntStack(opts.Capacity)
+    // exact is true until the trace reads input
+    exact := true
+
+    for calls := 1; true; calls++ {
+        if opts.MaxCalls > 0 && len(root.Children) > opts.MaxCalls {
+            return root, false
+        }
+        if opts.Context != nil && calls % ctxCheckInterval == 0 && opts.Context.Err() != nil {
+            return root, false
+        }
+        call := walker.Next()
+        if call.Op == Exit {
+            root.Append(call)
+            return root, true
+        }
+        if call.blocked() {
+            root.Append(call)
+            continue
+        }
+        op := call.Op
+        strict := opts.Strict && exact
+        // reason is why the spec ignores the op, empty when it doesn't
+        reason := ""
+        // a full stack ends the trace with a Trap
+        overflow := false
+        switch op {
+        case Switch: 
+            if val, ok := stack.Pop(); ok {
+               root.Append(call)
+               if val % 2 > 0 {
+                   walker.cc = walker.cc.Toggle()
+               }
+            } else {
+                reason = "stack underflow"
+            }
+        case Pointer:
+            if val, ok := stack.Pop(); ok {
+                root.Append(call)
+                walker.dp = walker.dp.Rotate(val)
+            } else {
+                reason = "stack underflow"
+            }
+        case Push: 
+            overflow = !stack.Push(call.Args[0])
+            root.Append(call)
+        case Add: 
+            if f, s, ok := stack.Pop2(); ok {
+               root.Append(call)
+               stack.Push(s + f)
+            } else {
+                reason = "stack underflow"
+            }
+        case Sub: 
+            if f, s, ok := stack.Pop2(); ok {
+                root.Append(call)
+                stack.Push(s - f)
+            } else {
+                reason = "stack underflow"
+            }
+        case Mult:
+            if f, s, ok := stack.Pop2(); ok {
+                root.Append(call)
+                stack.Push(s * f)
+            } else {
+                reason = "stack underflow"
+            }
+        case Div:
+            if f, s, ok := stack.Pop2(); !ok {
+                reason = "stack underflow"
+            } else if strict && f == 0 {
+                reason = "division by zero"
+            } else {
+                root.Append(call)
+                if f == 0 {
+                    stack.Push(s)
+                    stack.Push(f)
+                } else {
+                    stack.Push(FloorDiv(s, f))
+                }
+            }
+        case NumOut:
+            if _, ok := stack.Pop(); ok || !strict {
+                root.Append(call)
+            } else {
+                reason = "stack underflow"
+            }
+        case CharOut:
+            if _, ok := stack.Pop(); ok || !strict {
+                root.Append(call)
+            } else {
+                reason = "stack underflow"
+            }
+        case NumIn:
+            overflow = !stack.Push(-1) // TODO JH this should be an object that indicates unknown input
+            root.Append(call)
+            exact = false
+        case CharIn:
+            overflow = !stack.Push(-1) // TODO JH this should be an object that indicates unknown input
+            root.Append(call)
+            exact = false
+        case Roll:
+            if f, s, ok := stack.Pop2(); !ok {
+                reason = "stack underflow"
+            } else if strict && s < 0 {
+                reason = "negative roll depth"
+            } else if strict && int(s) > stack.Len() {
+                reason = "roll depth exceeds the stack"
+            } else {
+                root.Append(call)
+                if !stack.Roll(s, f) {
+                    stack.Push(s)
+                    stack.Push(f)
+                }
+            }
+        case Pop:
+            if _, ok := stack.Pop(); ok {
+                root.Append(call)
+            } else {
+                reason = "stack underflow"
+            }
+        case Dup:
+            if val, ok := stack.Peek(); ok {
+                root.Append(call)
+                overflow = !stack.Push(val)
+            } else {
+                reason = "stack underflow"
+            }
+        case Not:
+            if val, ok := stack.Pop(); ok {
+                root.Append(call)
+                if val == 0 {
+                    stack.Push(1)
+                } else {
+                    stack.Push(0)
+                }
+            } else {
+                reason = "stack underflow"
+            }
+        case Greater:
+            if f, s, ok := stack.Pop2(); ok {
+                root.Append(call)
+                if s > f {
+                    stack.Push(1)
+                } else {
+                    stack.Push(0)
+                }
+            } else {
+                reason = "stack underflow"
+            }
+        case Mod:
+            if f, s, ok := stack.Pop2(); !ok {
+                reason = "stack underflow"
+            } else if strict && f == 0 {
+                reason = "modulo by zero"
+            } else {
+                root.Append(call)
+                if f == 0 {
+                    stack.Push(s)
+                    stack.Push(f)
+                } else {
+                    stack.Push(FloorMod(s, f))
+                }
+            }
+        default:
+            panic(fmt.Sprintf("Unhandled operator %s", op))
+        }
+        if reason != "" && strict {
+            root.Append(call)
+            root.Append(Trap{Call: call, Reason: reason})
+            return root, true
+        }
+        if reason != "" && !exact {
+            // the real stack may hold the values the trace is missing
+            root.Append(call)
+        }
+        if overflow && exact {
+            root.Append(Trap{Call: call, Reason: "stack overflow"})
+            return root, true
+        }
+    }
+
+    return root, true
+}
+
+// walker moves the pointer through a program one call at a time. What the
+// ops do to the stack is left to its caller, which turns dp and cc for the
+// switch and pointer ops.
+type walker struct {
+    carrot Carrot
+    dp Dp
+    cc Cc
+    curShape *Shape
+    attempts int
+    // pending holds the calls of a move that produced more than one
+    pending []Call
+}
+func newWalker(tokens *PietTokens) *walker {
+    w := &walker{
+        carrot: Carrot{X: 0, Y: 0, tokens: tokens},
+        dp: DpRight,
+        cc: CcLeft,
+        attempts: 8,
+    }
+    w.curShape = w.carrot.CurrentShape()
+    return w
+}
+
+// Next moves the pointer until it performs an op and returns the call for it,
+// or a switch or pointer call with an argument when the move is blocked. Exit
+// is returned once the pointer can't move at all.
+func (w *walker) Next() Call {
+    if len(w.pending) > 0 {
+        call := w.pending[0]
+        w.pending = w.pending[1:]
+        return call
+    }
+    for {
+        if !w.carrot.Move(w.dp, w.cc) {
+            w.attempts -= 1
+            if w.attempts == 0 {
+                return Call{Op: Exit}
+            }
+            if w.attempts % 2 > 0 {
+                w.cc = w.cc.Toggle()
+                return Call{Op: Switch, Args: []int32 {1}}
+            }
+            w.dp = w.dp.Rotate(1)
+            return Call{Op: Pointer, Args: []int32 {1}}
+        }
+        nextShape := w.carrot.CurrentShape()
+        if nextShape.Color == White {
+            w.attempts -= 2
+            w.curShape = nextShape
+            w.pending = append(w.pending, Call{Op: Pointer, Args: []int32 {1}})
+            return Call{Op: Switch, Args: []int32 {1}}
+        }
+        op := w.curShape.Color.ToOp(nextShape.Color)
+        w.attempts = 8
+        call := Call{Op: op, Pos: image.Point{X: w.carrot.X, Y: w.carrot.Y}, Dp: w.dp, Cc: w.cc}
+        if op == Push {
+            call.Args = []int32 {w.curShape.Size}
+        }
+        w.curShape = nextShape
+        if op != Noop {
+            return call
+        }
+    }
+}
+
+type Carrot struct {
+    X, Y int
+    tokens *PietTokens
+}
+func (c *Carrot) CurrentShape() *Shape {
+    return c.tokens.At(c.X, c.Y)
+}
+func (c *Carrot) slideWhite(dp Dp, cc Cc) bool {
+    xAdj, yAdj := 0, 0
+    switch dp {
+    case DpRight:
+        xAdj = 1
+    case DpDown:
+        yAdj = 1
+    case DpLeft:
+        xAdj = -1
+    case DpUp:
+        yAdj = -1
+    }
+    curShape := c.tokens.At(c.X, c.Y)
+    width, height := c.tokens.Width(), c.tokens.Height()
+    for InBounds(c.X + xAdj, c.Y + yAdj, width, height) {
+        c.X += xAdj
+        c.Y += yAdj
+        if c.tokens.At(c.X, c.Y) != curShape {
+            if c.tokens.At(c.X, c.Y).Color == Black {
+                c.X -= xAdj
+                c.Y -= yAdj
+                return false
+            }
+            return true
+        }
+    }
+    return false
+}
+func (c *Carrot) Move(dp Dp, cc Cc) bool {
+    curShape := c.tokens.At(c.X, c.Y)
+    if curShape.Color == White {
+        return c.slideWhite(dp, cc)
+    }
+    xPos, yPos := c.next(dp, cc)
+    if InBounds(xPos, yPos, c.tokens.Width(), c.tokens.Height()) {
+        if c.tokens.At(xPos, yPos).Color == Black {
+            return false
+        }
+        c.X = xPos
+        c.Y = yPos
+        return true
+    }
+    return false
+}
+
+// next is the codel the pointer moves to when leaving the current block with
+// dp and cc, it may be outside the image.
+func (c *Carrot) next(dp Dp, cc Cc) (int, int) {
+    xPos, yPos := c.X, c.Y
+    curShape := c.tokens.At(c.X, c.Y)
+    switch dp {
+    case DpRight:
+        rightNode := curShape.xEdges.MaxNode()
+        xPos = rightNode.Key
+        if cc == CcLeft {
+            yPos = rightNode.Min
+        } else {
+            yPos = rightNode.Max
+        }
+        xPos += 1
+    case DpDown:
+        bottomNode := curShape.yEdges.MaxNode()
+        yPos = bottomNode.Key
+        if cc == CcLeft {
+            xPos = bottomNode.Max
+        } else {
+            xPos = bottomNode.Min
+        }
+        yPos += 1
+    case DpLeft:
+        leftNode := curShape.xEdges.MinNode()
+        xPos = leftNode.Key
+        if cc == CcLeft {
+            yPos = leftNode.Max
+        } else {
+            yPos = leftNode.Min
+        }
+        xPos -= 1
+    case DpUp:
+        topNode := curShape.yEdges.MinNode()
+        yPos = topNode.Key
+        if cc == CcLeft {
+            xPos = topNode.Min
+        } else {
+            xPos = topNode.Max
+        }
+        yPos -= 1
+    }
+    return xPos, yPos
+}
+
+type Edge struct {
+    Dp Dp
+    Cc Cc
+    MoveDp Dp
+    MoveCc Cc
+    Target int
+    Op Op
+    Data int32
+}
+
+// Program is the graph of colour blocks in a tokenized image. Every colour
+// block has one edge for each of the eight DP/CC states it can be entered
+// with, describing where the pointer ends up and which op is performed.
+type Program struct {
+    tokens *PietTokens
+    adjList [][]Edge
+    codelSize int
+}
+func Parse(tokens *PietTokens) *Program {
+    pg := Program{
+        tokens: tokens,
+        adjList: make([][]Edge, tokens.Size()),
+        codelSize: 1,
+    }
+    for idx, shape := range tokens.shapes {
+        if shape.Color == White || shape.Color == Black {
+            continue
+        }
+        for dp := DpRight; dp <= DpUp; dp++ {
+            for cc := CcLeft; cc <= CcRight; cc++ {
+                pg.adjList[idx] = append(pg.adjList[idx], pg.edgeFrom(idx, dp, cc))
+            }
+        }
+    }
+    return &pg
+}
+func (p *Program) Tokens() *PietTokens {
+    return p.tokens
+}
+// CodelSize is the size of the codels in the image the program was loaded
+// from, see Load.
+func (p *Program) CodelSize() int {
+    return p.codelSize
+}
+func (p *Program) Size() int {
+    return len(p.adjList)
+}
+func (p *Program) Start() int {
+    if p.tokens.Width() == 0 || p.tokens.Height() == 0 {
+        return -1
+    }
+    return p.tokens.data[0][0]
+}
+func (p *Program) Shape(idx int) *Shape {
+    return p.tokens.shapes[idx]
+}
+func (p *Program) Edges(idx int) []Edge {
+    return p.adjList[idx]
+}
+func (p *Program) GetEdge(idx int, dp Dp, cc Cc) (Edge, bool) {
+    if idx < 0 || idx >= len(p.adjList) {
+        return Edge{}, false
+    }
+    for _, edge := range p.adjList[idx] {
+        if edge.Dp == dp && edge.Cc == cc {
+            return edge, true
+        }
+    }
+    return Edge{}, false
+}
+// Reachable marks every colour block that can be entered when starting from
+// the top left codel. Pointer and switch ops are assumed to be able to produce
+// any DP or CC since their arguments are not known.
+func (p *Program) Reachable() []bool {
+    reachable := make([]bool, p.Size())
+    start := p.Start()
+    if start < 0 {
+        return reachable
+    }
+    reachable[start] = true
+    type state struct {
+        idx int
+        dp Dp
+        cc Cc
+    }
+    visited := map[state]bool{}
+    pending := []state{{idx: start, dp: DpRight, cc: CcLeft}}
+    for len(pending) > 0 {
+        cur := pending[len(pending) - 1]
+        pending = pending[:len(pending) - 1]
+        if visited[cur] {
+            continue
+        }
+        visited[cur] = true
+        edge, ok := p.GetEdge(cur.idx, cur.dp, cur.cc)
+        if !ok || edge.Op == Exit {
+            continue
+        }
+        reachable[edge.Target] = true
+        for rotation := int32(0); rotation < 4; rotation++ {
+            if rotation > 0 && edge.Op != Pointer {
+                break
+            }
+            dp := edge.MoveDp.Rotate(rotation)
+            pending = append(pending, state{idx: edge.Target, dp: dp, cc: edge.MoveCc})
+            if edge.Op == Switch {
+                pending = append(pending, state{idx: edge.Target, dp: dp, cc: edge.MoveCc.Toggle()})
+            }
+        }
+    }
+    return reachable
+}
+func (p *Program) edgeFrom(idx int, dp Dp, cc Cc) Edge {
+    shape := p.tokens.shapes[idx]
+    edge := Edge{Dp: dp, Cc: cc, Target: -1, Op: Exit}
+    moveDp, moveCc := dp, cc
+    for attempt := 0; attempt < 8; attempt++ {
+        carrot := Carrot{X: shape.xEdges.Key, Y: shape.xEdges.Min, tokens: p.tokens}
+        if carrot.Move(moveDp, moveCc) {
+            var op Op = Noop
+            if carrot.CurrentShape().Color != White {
+                op = shape.Color.ToOp(carrot.CurrentShape().Color)
+            }
+            if op != Noop || carrot.Move(moveDp, moveCc) {
+                edge.MoveDp, edge.MoveCc = moveDp, moveCc
+                edge.Target = p.tokens.data[carrot.X][carrot.Y]
+                edge.Op = op
+                if op == Push {
+                    edge.Data = shape.Size
+                }
+                return edge
+            }
+        }
+        if attempt % 2 == 0 {
+            moveCc = moveCc.Toggle()
+        } else {
+            moveDp = moveDp.Rotate(1)
+        }
+    }
+    edge.MoveDp, edge.MoveCc = moveDp, moveCc
+    return edge
+}
+
+/*
+[Stmt]        | (Assign | Call | If)
+[Assign]      | Name Int
+[If]          | EqExpr Block Stmt?
+[EqExpr]      | Name Int
+[Block]       | Stmt+
+[Call]        | Name Int?
+[Int]         | (int32)
+*/
+
+type AstNode interface {
+}
+type Stmt interface {
+    AstNode
+}
+type Assign struct {
+    Name string
+    val int32    
+}
+type StmtBlock struct {
+    Children []Stmt
+}
+func (s *StmtBlock) Append(stmt Stmt) {
+    s.Children = append(s.Children, stmt)
+}
+type StmtIf struct {
+    Condition EqExpr
+    Block StmtBlock
+    Else Stmt
+}
+type EqExpr struct {
+    Name string
+    val int32
+}
+type Call struct {
+    Op Op
+    // Args holds the values for push, pushed in order. Switch and pointer calls with an
+    // argument use it instead of popping, ParseStmt emits them to keep the
+    // pointer in step when a move is blocked.
+    Args []int32
+    // Pos is the codel the op was performed on, Dp and Cc the pointer
+    // state at that point.
+    Pos image.Point
+    Dp Dp
+    Cc Cc
+}
+// blocked is true for the switch and pointer calls emitted to keep the
+// pointer in step, they don't pop.
+func (c Call) blocked() bool {
+    return (c.Op == Switch || c.Op == Pointer) && len(c.Args) > 0
+}
+
+// Trap ends a trace that stopped because Call failed. The interpreter reports
+// it as an Error, compiled programs write it to stderr and exit with status 1.
+type Trap struct {
+    Call Call
+    Reason string
+}
+// Message describes the failure like Error does, without the stack.
+func (t Trap) Message() string {
+    return fmt.Sprintf("%s at (%d, %d) dp %s cc %s: %s",
+        t.Call.Op, t.Call.Pos.X, t.Call.Pos.Y, t.Call.Dp, t.Call.Cc, t.Reason)
+}
+
+// Encoding is how CharIn and CharOut turn characters into stack values.
+type Encoding byte
+const (
+    EncodingUTF8 Encoding = 0
+    EncodingBytes Encoding = 1
+)
+func (e Encoding) String() string {
+    switch e {
+    case EncodingUTF8:
+        return "utf8"
+    case EncodingBytes:
+        return "bytes"
+    default:
+        return "unknown"
+    }
+}
+func ParseEncoding(name string) (Encoding, error) {
+    for encoding := EncodingUTF8; encoding <= EncodingBytes; encoding++ {
+        if encoding.String() == name {
+            return encoding, nil
+        }
+    }
+    return EncodingUTF8, fmt.Errorf("unrecognized encoding %s, expected one of (bytes, utf8)", name)
+}
+
+type Interpreter struct {
+    Dp Dp
+    Cc Cc
+    Stack *Stack[int32]
+    Input *bufio.Reader
+    Output io.Writer
+    Encoding Encoding
+    // Strict stops at the first op that the spec would silently ignore.
+    Strict bool
+    // MaxSteps stops the interpreter with a LimitError before it runs more
+    // calls than this, 0 means no limit.
+    MaxSteps int
+}
+// NewInterpreter reads from os.Stdin and writes to os.Stdout.
+func NewInterpreter(capacity int) *Interpreter {
+    return NewInterpreterWith(capacity, os.Stdin, os.Stdout)
+}
+func NewInterpreterWith(capacity int, in io.Reader, out io.Writer) *Interpreter {
+    return &Interpreter{
+        Stack: NewIntStack(capacity),
+        Input: bufio.NewReader(in),
+        Output: out,
+    }
+}
+
+// Result describes how Interpret finished.
+type Result struct {
+    // Exited is true when the program reached its exit rather than the end
+    // of the statements it was given.
+    Exited bool
+    // Steps is the number of calls that were executed.
+    Steps int
+}
+
+// Error is returned when a program can't go on. X and Y are the codel
+// coordinates the pointer moved to when the op was performed.
+type Error struct {
+    X, Y int
+    Op Op
+    Dp Dp
+    Cc Cc
+    Reason string
+    // Stack is the stack at the time of the error.
+    Stack string
+}
+func (e Error) Error() string {
+    return fmt.Sprintf("%s at (%d, %d) dp %s cc %s: %s, stack %s",
+        e.Op, e.X, e.Y, e.Dp, e.Cc, e.Reason, e.Stack)
+}
+
+// ErrMaxSteps is the cause of a LimitError when Interpreter.MaxSteps is hit.
+var ErrMaxSteps = errors.New("step limit reached")
+
+// LimitError is returned when a run is stopped before it finished, by a step
+// limit or its context. X and Y are the codel coordinates of the op that
+// would have run next.
+type LimitError struct {
+    Steps int
+    X, Y int
+    Op Op
+    Dp Dp
+    Cc Cc
+    // Err is ErrMaxSteps or the context's error.
+    Err error
+}
+func (e LimitError) Error() string {
+    return fmt.Sprintf("stopped after %d steps before %s at (%d, %d) dp %s cc %s: %s",
+        e.Steps, e.Op, e.X, e.Y, e.Dp, e.Cc, e.Err)
+}
+func (e LimitError) Unwrap() error {
+    return e.Err
+}
+
+func (interpreter *Interpreter) limit(call Call, steps int, err error) error {
+    return LimitError{
+        Steps: steps,
+        X: call.Pos.X,
+        Y: call.Pos.Y,
+        Op: call.Op,
+        Dp: call.Dp,
+        Cc: call.Cc,
+        Err: err,
+    }
+}
+
+func (interpreter *Interpreter) fail(call Call, reason string) error {
+    return Error{
+        X: call.Pos.X,
+        Y: call.Pos.Y,
+        Op: call.Op,
+        Dp: call.Dp,
+        Cc: call.Cc,
+        Reason: reason,
+        Stack: interpreter.Stack.String(),
+    }
+}
+
+// readNumber reads a signed decimal integer, skipping any whitespace in front
+// of it. The first byte after the digits is left unread.
+func readNumber(input *bufio.Reader) (int32, error) {
+    b, err := input.ReadByte()
+    for err == nil && (b == ' ' || (b >= '\t' && b <= '\r')) {
+        b, err = input.ReadByte()
+    }
+    negative := false
+    if err == nil && (b == '-' || b == '+') {
+        negative = b == '-'
+        b, err = input.ReadByte()
+    }
+    var val int64
+    digits := 0
+    for ; err == nil && b >= '0' && b <= '9'; digits++ {
+        if val <= math.MaxInt32 + 1 {
+            val = val * 10 + int64(b - '0')
+        }
+        b, err = input.ReadByte()
+    }
+    if err == nil {
+        input.UnreadByte()
+    } else if err != io.EOF {
+        return 0, err
+    }
+    if digits == 0 {
+        if err == io.EOF {
+            return 0, io.ErrUnexpectedEOF
+        }
+        return 0, fmt.Errorf("invalid number input %q", b)
+    }
+    if negative {
+        val = -val
+    }
+    if val > math.MaxInt32 || val < math.MinInt32 {
+        return 0, fmt.Errorf("number input out of range")
+    }
+    return int32(val), nil
+}
+
+func (interpreter *Interpreter) Interpret(stmt Stmt) (Result, error) {
+    return interpreter.InterpretContext(context.Background(), stmt)
+}
+
+// InterpretContext is Interpret but stops with a LimitError once the context
+// is done.
+func (interpreter *Interpreter) InterpretContext(ctx context.Context, stmt Stmt) (Result, error) {
+    result := Result{}
+    err := interpreter.interpret(ctx, stmt, &result)
+    return result, err
+}
+
+// ctxCheckInterval is how many calls run between checks of the context.
+const ctxCheckInterval = 1024
+
+func (interpreter *Interpreter) interpret(ctx context.Context, stmt Stmt, result *Result) error {
+    if stmt == nil {
+        return nil
+    }
+    if assign, ok := stmt.(Assign); ok {
+        if assign.Name == "dp" {
+            interpreter.Dp = Dp(assign.val)
+        } else if assign.Name == "cc" {
+            interpreter.Cc = Cc(assign.val)
+        }
+    } else if block, ok := stmt.(StmtBlock); ok {
+        for _, s := range block.Children {
+            if err := interpreter.interpret(ctx, s, result); err != nil || result.Exited {
+                return err
+            }
+        }
+    } else if trap, ok := stmt.(Trap); ok {
+        return interpreter.fail(trap.Call, trap.Reason)
+    } else if call, ok := stmt.(Call); ok {
+        if interpreter.MaxSteps > 0 && result.Steps >= interpreter.MaxSteps {
+            return interpreter.limit(call, result.Steps, ErrMaxSteps)
+        }
+        if result.Steps % ctxCheckInterval == 0 {
+            if err := ctx.Err(); err != nil {
+                return interpreter.limit(call, result.Steps, err)
+            }
+        }
+        result.Steps += 1
+        if call.Op == Exit {
+            result.Exited = true
+            _, err := io.WriteString(interpreter.Output, "\n")
+            return err
+        }
+        return interpreter.call(call)
+    }
+    return nil
+}
+
+func (interpreter *Interpreter) call(call Call) error {
+    stack := interpreter.Stack
+    ok := true
+    overflow := false
+    switch call.Op {
+        case Push:
+            for _, arg := range call.Args {
+                if overflow = !stack.Push(arg); overflow {
+                    break
+                }
+            }
+        case Pop:
+            _, ok = stack.Pop()
+        case Add:
+            var f, s int32
+            if f, s, ok = stack.Pop2(); ok {
+                stack.Push(s + f)
+            }
+        case Sub:
+            var f, s int32
+            if f, s, ok = stack.Pop2(); ok {
+                stack.Push(s - f)
+            }
+        case Mult:
+            var f, s int32
+            if f, s, ok = stack.Pop2(); ok {
+                stack.Push(s * f)
+            }
+        case Div:
+            var f, s int32
+            if f, s, ok = stack.Pop2(); ok {
+                if f == 0 {
+                    stack.Push(s)
+                    stack.Push(f)
+                    if interpreter.Strict {
+                        return interpreter.fail(call, "division by zero")
+                    }
+                } else {
+                    stack.Push(FloorDiv(s, f))
+                }
+            }
+        case Mod:
+            var f, s int32
+            if f, s, ok = stack.Pop2(); ok {
+                if f == 0 {
+                    stack.Push(s)
+                    stack.Push(f)
+                    if interpreter.Strict {
+                        return interpreter.fail(call, "modulo by zero")
+                    }
+                } else {
+                    stack.Push(FloorMod(s, f))
+                }
+            }
+        case Dup:
+            var val int32
+            if val, ok = stack.Peek(); ok {
+                overflow = !stack.Push(val)
+            }
+        case Not:
+            var val int32
+            if val, ok = stack.Pop(); ok {
+                if val == 0 {
+                    stack.Push(1)
+                } else {
+                    stack.Push(0)
+                }
+            }
+        case Greater:
+            var f, s int32
+            if f, s, ok = stack.Pop2(); ok {
+                if s > f {
+                    stack.Push(1)
+                } else {
+                    stack.Push(0)
+                }
+            }
+        case Switch:
+            var val int32
+            if len(call.Args) > 0 {
+                val = call.Args[0]
+            } else {
+                val, ok = stack.Pop()
+            }
+            if ok && val % 2 > 0 {
+                interpreter.Cc = interpreter.Cc.Toggle()
+            }
+        case Pointer:
+            var val int32
+            if len(call.Args) > 0 {
+                val = call.Args[0]
+            } else {
+                val, ok = stack.Pop()
+            }
+            if ok {
+                interpreter.Dp = interpreter.Dp.Rotate(val)
+            }
+        case NumOut:
+            var val int32
+            if val, ok = stack.Pop(); ok {
+                if _, err := fmt.Fprint(interpreter.Output, val); err != nil {
+                    return err
+                }
+            }
+        case CharOut:
+            var val int32
+            if val, ok = stack.Pop(); ok {
+                var err error
+                if interpreter.Encoding == EncodingBytes {
+                    _, err = interpreter.Output.Write([]byte{byte(val)})
+                } else {
+                    _, err = io.WriteString(interpreter.Output, string(rune(val)))
+                }
+                if err != nil {
+                    return err
+                }
+            }
+        case NumIn:
+            val, err := readNumber(interpreter.Input)
+            if err != nil {
+                if interpreter.Strict {
+                    return interpreter.fail(call, fmt.Sprint(err))
+                }
+                break
+            }
+            overflow = !stack.Push(val)
+        case CharIn:
+            var val int32
+            var err error
+            if interpreter.Encoding == EncodingBytes {
+                var b byte
+                b, err = interpreter.Input.ReadByte()
+                val = int32(b)
+            } else {
+                var r rune
+                r, _, err = interpreter.Input.ReadRune()
+                val = int32(r)
+            }
+            if err != nil {
+                if interpreter.Strict {
+                    return interpreter.fail(call, fmt.Sprint(err))
+                }
+                break
+            }
+            overflow = !stack.Push(val)
+        case Roll:
+            var f, s int32
+            if f, s, ok = stack.Pop2(); ok && !stack.Roll(s, f) {
+                stack.Push(s)
+                stack.Push(f)
+                if interpreter.Strict {
+                    if s < 0 {
+                        return interpreter.fail(call, "negative roll depth")
+                    }
+                    return interpreter.fail(call, "roll depth exceeds the stack")
+                }
+            }
+        default:
+            panic(fmt.Sprintf("%s not supported", call.Op))
+    }
+    if overflow {
+        return interpreter.fail(call, "stack overflow")
+    }
+    if !ok && interpreter.Strict {
+        return interpreter.fail(call, "stack underflow")
+    }
+    return nil
+}
+
+// asmProgram is what the asm template is executed with.
+type asmProgram struct {
+    Stmt Stmt
+    Utf8 bool
+    // StackSize is the number of values the stack buffer holds.
+    StackSize int
+}
+
+// defaultAsmStackSize sizes the stack buffer of compiled programs without a
+// capacity.
+const defaultAsmStackSize = 1 << 20
+
+func CompileTmpl(stmt Stmt, f io.Writer, encoding Encoding) {
+    if err := compileAsm(f, stmt, encoding, defaultAsmStackSize); err != nil {
+        panic(err)
+    }
+}
+
+func compileAsm(w io.Writer, stmt Stmt, encoding Encoding, stackSize int) error {
+    return asmTemplate.Execute(w, asmProgram{Stmt: stmt, Utf8: encoding == EncodingUTF8, StackSize: stackSize})
+}
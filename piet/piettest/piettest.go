@@ -0,0 +1,67 @@
+// Package piettest runs golden Piet programs from go test.
+package piettest
+
+import (
+    "context"
+    "testing"
+
+    "github.com/jasonhightower/go-piet/piet"
+)
+
+// Golden runs every golden case in dir as a subtest, see piet.GoldenCase.
+func Golden(t *testing.T, dir string) {
+    t.Helper()
+    cases, err := piet.FindGoldenCases(dir)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(cases) == 0 {
+        t.Fatalf("no golden programs in %s", dir)
+    }
+    for _, c := range cases {
+        c := c
+        t.Run(c.Name, func(t *testing.T) {
+            result := c.Run()
+            if result.Err != nil {
+                t.Errorf("%s", result.Err)
+            }
+            if result.Output != result.Expected {
+                t.Errorf("output differs from %s\n%s", c.Output, result.Diff())
+            }
+        })
+    }
+}
+
+// Differential runs every golden case in dir with the interpreter and the
+// compile targets from piet.Backends, failing on any disagreement. Targets
+// that can't run here are logged and skipped.
+func Differential(t *testing.T, dir string) {
+    t.Helper()
+    cases, err := piet.FindGoldenCases(dir)
+    if err != nil {
+        t.Fatal(err)
+    }
+    for _, c := range cases {
+        c := c
+        t.Run(c.Name, func(t *testing.T) {
+            prog, opts, input, err := c.Load()
+            if err != nil {
+                t.Fatal(err)
+            }
+            ctx, cancel := context.WithTimeout(context.Background(), piet.GoldenTimeout)
+            defer cancel()
+            report, err := piet.Differential(ctx, prog, input, opts, piet.Backends()...)
+            if err != nil {
+                t.Fatal(err)
+            }
+            for _, result := range report.Results {
+                if result.Skipped != nil {
+                    t.Logf("skipped %s: %s", result.Backend, result.Skipped)
+                }
+            }
+            for _, result := range report.Disagreements() {
+                t.Errorf("%s", report.Describe(result))
+            }
+        })
+    }
+}
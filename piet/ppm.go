@@ -0,0 +1,184 @@
+package piet
+
+import (
+    "bufio"
+    "errors"
+    "fmt"
+    "image"
+    "image/color"
+    "io"
+    "strconv"
+)
+
+// Decoding for the plain (P3) and raw (P6) variants of the netpbm PPM format.
+
+func init() {
+    image.RegisterFormat("ppm", "P3", decodePPM, decodePPMConfig)
+    image.RegisterFormat("ppm", "P6", decodePPM, decodePPMConfig)
+}
+
+type ppmHeader struct {
+    magic string
+    width int
+    height int
+    maxval int
+}
+
+func readPPMHeader(r *bufio.Reader) (ppmHeader, error) {
+    header := ppmHeader{}
+    magic, err := ppmToken(r)
+    if err != nil {
+        return header, err
+    }
+    if magic != "P3" && magic != "P6" {
+        return header, fmt.Errorf("ppm: unsupported format %s", magic)
+    }
+    header.magic = magic
+    values := []*int{&header.width, &header.height, &header.maxval}
+    for _, value := range values {
+        token, err := ppmToken(r)
+        if err != nil {
+            return header, err
+        }
+        *value, err = strconv.Atoi(token)
+        if err != nil || *value < 0 {
+            return header, fmt.Errorf("ppm: invalid header value %s", token)
+        }
+    }
+    if header.maxval < 1 || header.maxval > 0xFFFF {
+        return header, fmt.Errorf("ppm: invalid maximum value %d", header.maxval)
+    }
+    if err := checkImageSize("ppm", header.width, header.height); err != nil {
+        return header, err
+    }
+    return header, nil
+}
+
+// ppmToken reads the next whitespace separated token, skipping comments. The
+// single whitespace byte that ends the token is consumed.
+func ppmToken(r *bufio.Reader) (string, error) {
+    token := []byte{}
+    for {
+        b, err := r.ReadByte()
+        if err == io.EOF && len(token) > 0 {
+            return string(token), nil
+        }
+        if err != nil {
+            return "", err
+        }
+        if b == '#' {
+            if _, err := r.ReadString('\n'); err != nil && err != io.EOF {
+                return "", err
+            }
+            if len(token) > 0 {
+                return string(token), nil
+            }
+            continue
+        }
+        if b == ' ' || b == '\t' || b == '\n' || b == '\r' || b == '\v' || b == '\f' {
+            if len(token) > 0 {
+                return string(token), nil
+            }
+            continue
+        }
+        token = append(token, b)
+    }
+}
+
+func decodePPMConfig(r io.Reader) (image.Config, error) {
+    header, err := readPPMHeader(bufio.NewReader(r))
+    if err != nil {
+        return image.Config{}, err
+    }
+    model := color.RGBAModel
+    if header.maxval > 0xFF {
+        model = color.RGBA64Model
+    }
+    return image.Config{ColorModel: model, Width: header.width, Height: header.height}, nil
+}
+
+func decodePPM(r io.Reader) (image.Image, error) {
+    br := bufio.NewReader(r)
+    header, err := readPPMHeader(br)
+    if err != nil {
+        return nil, err
+    }
+
+    samples, err := readPPMSamples(br, header)
+    if err != nil {
+        return nil, err
+    }
+
+    rect := image.Rect(0, 0, header.width, header.height)
+    img := image.NewRGBA64(rect)
+    for y := 0; y < header.height; y++ {
+        for x := 0; x < header.width; x++ {
+            rgb := samples[(y * header.width + x) * 3:]
+            img.SetRGBA64(x, y, color.RGBA64{R: rgb[0], G: rgb[1], B: rgb[2], A: 0xFFFF})
+        }
+    }
+    if header.maxval > 0xFF {
+        return img, nil
+    }
+    rgba := image.NewRGBA(rect)
+    for y := 0; y < header.height; y++ {
+        for x := 0; x < header.width; x++ {
+            rgba.Set(x, y, img.At(x, y))
+        }
+    }
+    return rgba, nil
+}
+
+// readPPMSamples reads the three samples of every pixel scaled to 16 bits. All
+// of them are read before the image is allocated, so a header can't ask for
+// more memory than the input backs.
+func readPPMSamples(br *bufio.Reader, header ppmHeader) ([]uint16, error) {
+    count := header.width * header.height * 3
+    scale := func(val int) (uint16, error) {
+        if val > header.maxval {
+            return 0, errors.New("ppm: sample exceeds maximum value")
+        }
+        return uint16(val * 0xFFFF / header.maxval), nil
+    }
+    samples := []uint16{}
+    if header.magic == "P6" {
+        size := 1
+        if header.maxval > 0xFF {
+            size = 2
+        }
+        data, err := readData(br, count * size)
+        if err != nil {
+            return nil, err
+        }
+        samples = make([]uint16, count)
+        for i := range samples {
+            val := int(data[i * size])
+            if size == 2 {
+                val = val << 8 | int(data[i * size + 1])
+            }
+            if samples[i], err = scale(val); err != nil {
+                return nil, err
+            }
+        }
+        return samples, nil
+    }
+    for len(samples) < count {
+        token, err := ppmToken(br)
+        if err == io.EOF {
+            return nil, io.ErrUnexpectedEOF
+        }
+        if err != nil {
+            return nil, err
+        }
+        val, err := strconv.Atoi(token)
+        if err != nil || val < 0 {
+            return nil, fmt.Errorf("ppm: invalid sample %s", token)
+        }
+        sample, err := scale(val)
+        if err != nil {
+            return nil, err
+        }
+        samples = append(samples, sample)
+    }
+    return samples, nil
+}
@@ -0,0 +1,196 @@
+package piet
+
+import (
+    "bytes"
+    "context"
+    "fmt"
+    "image"
+    "io"
+    "os/exec"
+    "strings"
+)
+
+// LoadOptions control how Load reads the codels of an image.
+type LoadOptions struct {
+    // CodelSize is the size of a codel in pixels, 0 detects it from the image.
+    CodelSize int
+    Sampling CodelSampling
+    UnknownColor UnknownColorPolicy
+}
+
+// Load turns an image into a Program. A codelSize of 0 detects the codel size
+// from the image.
+func Load(img image.Image, codelSize int) (*Program, error) {
+    return LoadWith(img, LoadOptions{CodelSize: codelSize})
+}
+
+func LoadWith(img image.Image, opts LoadOptions) (*Program, error) {
+    img, err := NewPolicyImage(img, opts.UnknownColor)
+    if err != nil {
+        return nil, err
+    }
+    codelSize := opts.CodelSize
+    if codelSize == 0 {
+        codelSize = DetectCodelSize(img)
+    }
+    if codelSize > 1 || img.Bounds().Min != (image.Point{}) {
+        img, err = NewSampledCodelImage(img, codelSize, opts.Sampling)
+        if err != nil {
+            return nil, err
+        }
+    }
+    prog := Parse(Tokenize(img))
+    prog.codelSize = codelSize
+    return prog, nil
+}
+
+// Options control how a Program is run or compiled.
+type Options struct {
+    // Capacity is the most values the stack may hold, each takes 4 bytes.
+    // 0 means the stack can grow without limit.
+    Capacity int
+    // Strict stops at the first op that the spec would silently ignore, Run
+    // reports it as an Error and compiled programs end with a Trap there.
+    Strict bool
+    Encoding Encoding
+    // MaxSteps stops Run with a LimitError before it runs more calls than
+    // this, 0 means no limit. Compile uses it to bound the trace instead.
+    MaxSteps int
+    // Optimize is the level the trace is optimized at, see Optimize. Steps
+    // count the optimized calls. Run only optimizes programs that finish
+    // within maxOptimizeCalls calls without reading input.
+    Optimize int
+}
+
+// maxOptimizeCalls is the longest trace Run optimizes, longer programs run
+// unoptimized.
+const maxOptimizeCalls = 1 << 20
+
+// Run runs prog reading input from in and writing output to out. It returns
+// a LimitError when opts.MaxSteps is hit or ctx is done first. ctx is only
+// checked between calls, a run blocked reading from in isn't interrupted.
+//
+// The program is interpreted as the pointer moves, so output is written as
+// it is produced, input is read when the program asks for it and a program
+// that never exits runs in constant memory until MaxSteps or ctx stops it.
+func Run(ctx context.Context, prog *Program, in io.Reader, out io.Writer, opts Options) (Result, error) {
+    interpreter := NewInterpreterWith(opts.Capacity, in, out)
+    interpreter.Strict = opts.Strict
+    interpreter.Encoding = opts.Encoding
+    interpreter.MaxSteps = opts.MaxSteps
+    if opts.Optimize > 0 {
+        // the trace only matches the real run when it reads no input
+        maxCalls := maxOptimizeCalls
+        if opts.MaxSteps > 0 && opts.MaxSteps < maxCalls {
+            maxCalls = opts.MaxSteps
+        }
+        stmt, ok := ParseStmtWith(prog.Tokens(), ParseOptions{
+            Capacity: opts.Capacity,
+            MaxCalls: maxCalls,
+            Strict: opts.Strict,
+            Context: ctx,
+        })
+        if ok && !readsInput(stmt) {
+            return interpreter.InterpretContext(ctx, Optimize(stmt, opts.Optimize))
+        }
+    }
+    return interpretLive(ctx, interpreter, prog.Tokens())
+}
+
+// interpretLive runs the calls of a walker through tokens on interpreter as
+// they are produced. The switch and pointer ops turn the walker the way they
+// turned the interpreter.
+func interpretLive(ctx context.Context, interpreter *Interpreter, tokens *PietTokens) (Result, error) {
+    result := Result{}
+    walker := newWalker(tokens)
+    for {
+        call := walker.Next()
+        dp, cc := interpreter.Dp, interpreter.Cc
+        if err := interpreter.interpret(ctx, call, &result); err != nil || result.Exited {
+            return result, err
+        }
+        if !call.blocked() {
+            walker.dp = walker.dp.Rotate(int32(interpreter.Dp) - int32(dp))
+            if interpreter.Cc != cc {
+                walker.cc = walker.cc.Toggle()
+            }
+        }
+    }
+}
+
+func readsInput(stmt StmtBlock) bool {
+    for _, child := range stmt.Children {
+        if call, ok := child.(Call); ok && (call.Op == NumIn || call.Op == CharIn) {
+            return true
+        }
+    }
+    return false
+}
+
+// Compile writes prog as macho64 nasm assembly to w. Tracing the program
+// stops with an error wrapping ErrMaxSteps or the context's error when
+// opts.MaxSteps is hit or ctx is done first.
+func Compile(ctx context.Context, prog *Program, w io.Writer, opts Options) error {
+    stmt, ok := ParseStmtWith(prog.Tokens(), ParseOptions{Capacity: opts.Capacity, MaxCalls: opts.MaxSteps, Strict: opts.Strict, Context: ctx})
+    if !ok {
+        if err := ctx.Err(); err != nil {
+            return fmt.Errorf("program did not finish tracing: %w", err)
+        }
+        return fmt.Errorf("program did not finish within %d steps: %w", opts.MaxSteps, ErrMaxSteps)
+    }
+    stmt = Optimize(stmt, opts.Optimize)
+    return compileAsm(w, stmt, opts.Encoding, asmStackSize(prog, stmt, opts.Capacity))
+}
+
+// asmStackSize sizes the stack buffer of a compiled program. It holds the most
+// values AnalyzeStack finds the program can have, or capacity values when
+// that is smaller or the stack may grow without bound. The graph only
+// approximates runs through white blocks, so it is never smaller than what
+// the compiled trace needs.
+func asmStackSize(prog *Program, stmt Stmt, capacity int) int {
+    size := prog.AnalyzeStack().MaxDepth
+    if capacity > 0 && capacity < size {
+        size = capacity
+    }
+    if size == UnboundedDepth {
+        size = defaultAsmStackSize
+    }
+    if depth := traceDepth(stmt); depth > size {
+        size = depth
+    }
+    return size
+}
+
+// Assemble builds the executable output from the assembly written by Compile
+// with nasm and the macOS linker.
+func Assemble(asmFile string, output string) error {
+    // nasm -fmacho64 tetris.asm
+    if out, err := exec.Command("nasm", "-fmacho64", asmFile).CombinedOutput(); err != nil {
+        return fmt.Errorf("%s: %s", err, out)
+    }
+    xcodePath, err := exec.Command("xcode-select", "-p").Output()
+    if err != nil {
+        return err
+    }
+    xcodePathStr := strings.TrimSpace(string(xcodePath))
+    objFile := strings.TrimSuffix(asmFile, ".asm") + ".o"
+    // ld -e _main  -macosx_version_min 10.10 -arch x86_64 -lSystem -L$(xcode-select -p)/SDKs/MacOSX.sdk/usr/lib -o tetris tetris.o
+    cmd := exec.Command("ld", "-v",
+                              "-e",
+                              "_main",
+                              "-macosx_version_min",
+                              "10.10",
+                              "-arch",
+                              "x86_64",
+                              "-lSystem",
+                              fmt.Sprintf("-L%s/SDKs/MacOSX.sdk/usr/lib", xcodePathStr),
+                              "-o",
+                              output,
+                              objFile)
+    var stderr bytes.Buffer
+    cmd.Stderr = &stderr
+    if err := cmd.Run(); err != nil {
+        return fmt.Errorf("%s: %s", err, stderr.String())
+    }
+    return nil
+}
@@ -0,0 +1,259 @@
+package piet
+
+import (
+    "context"
+    "errors"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestLoadAndRun(t *testing.T) {
+    img, err := ReadImage("../examples/Piet_Hello_World.gif")
+    if err != nil {
+        t.Fatal(err)
+    }
+    prog, err := Load(img, 0)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if prog.CodelSize() != 11 {
+        t.Errorf("Expected codel size 11, got %d", prog.CodelSize())
+    }
+    var output strings.Builder
+    result, err := Run(context.Background(), prog, strings.NewReader(""), &output, Options{Capacity: 512})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !result.Exited || output.String() != "Hello, world!\n\n" {
+        t.Errorf("Expected the program to greet and exit, got %q %v", output.String(), result)
+    }
+
+    var asm strings.Builder
+    if err := Compile(context.Background(), prog, &asm, Options{Capacity: 512}); err != nil {
+        t.Fatal(err)
+    }
+    if !strings.Contains(asm.String(), "_main:") {
+        t.Errorf("Expected the assembly to define _main")
+    }
+}
+
+func TestRunCancelled(t *testing.T) {
+    img, err := ReadImage("../examples/tetris.gif")
+    if err != nil {
+        t.Fatal(err)
+    }
+    prog, err := Load(img, 1)
+    if err != nil {
+        t.Fatal(err)
+    }
+    ctx, cancel := context.WithCancel(context.Background())
+    cancel()
+    var output strings.Builder
+    _, err = Run(ctx, prog, strings.NewReader(""), &output, Options{Capacity: 512})
+    if _, ok := err.(LimitError); !ok || !errors.Is(err, context.Canceled) {
+        t.Errorf("Expected the run to be cancelled, got %v", err)
+    }
+    if output.Len() != 0 {
+        t.Errorf("Expected no output from a cancelled run, got %q", output.String())
+    }
+}
+
+func TestRunStrictError(t *testing.T) {
+    tImg := NewTestImage(3, 1)
+    tImg.Set(0, 0, colToColor[LightRed])
+    tImg.Set(1, 0, colToColor[LightYellow])
+    tImg.Set(2, 0, colToColor[MediumYellow])
+
+    prog, err := Load(tImg, 1)
+    if err != nil {
+        t.Fatal(err)
+    }
+    _, err = Run(context.Background(), prog, strings.NewReader(""), &strings.Builder{}, Options{Capacity: 16, Strict: true})
+    pietErr, ok := err.(Error)
+    if !ok {
+        t.Fatalf("Expected an Error, got %v", err)
+    }
+    if pietErr.Op != Add || pietErr.X != 1 || pietErr.Y != 0 || pietErr.Reason != "stack underflow" {
+        t.Errorf("Expected a stack underflow for the add at (1, 0), got %s", pietErr)
+    }
+}
+
+func TestRunStrictInput(t *testing.T) {
+    // 1 / (in(number) + 1), the trace can't tell if it divides by zero
+    prog := Parse(Tokenize(linearProgram(Push, NumIn, Push, Add, Div, NumOut)))
+    var output strings.Builder
+    result, err := Run(context.Background(), prog, strings.NewReader("1"), &output, Options{Capacity: 16, Strict: true})
+    if err != nil || !result.Exited || output.String() != "0\n" {
+        t.Errorf("Expected 1 / 2 to print 0, got %q %v %v", output.String(), result, err)
+    }
+    _, err = Run(context.Background(), prog, strings.NewReader("-1"), &strings.Builder{}, Options{Capacity: 16, Strict: true})
+    if pietErr, ok := err.(Error); !ok || pietErr.Op != Div || pietErr.Reason != "division by zero" {
+        t.Errorf("Expected a division by zero, got %v", err)
+    }
+}
+
+// loopingProgram bounces between a light red and a light yellow block forever.
+func loopingProgram(t *testing.T) *Program {
+    tImg := NewTestImage(2, 1)
+    tImg.Set(0, 0, colToColor[LightRed])
+    tImg.Set(1, 0, colToColor[LightYellow])
+    prog, err := Load(tImg, 1)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return prog
+}
+
+func TestRunMaxSteps(t *testing.T) {
+    result, err := Run(context.Background(), loopingProgram(t), strings.NewReader(""), &strings.Builder{}, Options{Capacity: 16, MaxSteps: 100})
+    limitErr, ok := err.(LimitError)
+    if !ok || !errors.Is(err, ErrMaxSteps) {
+        t.Fatalf("Expected the step limit to stop the program, got %v", err)
+    }
+    if limitErr.Steps != 100 || result.Steps != 100 {
+        t.Errorf("Expected to stop after 100 steps, got %d and %d", limitErr.Steps, result.Steps)
+    }
+    if limitErr.X < 0 || limitErr.X > 1 || limitErr.Y != 0 {
+        t.Errorf("Expected the position of a block in the program, got (%d, %d)", limitErr.X, limitErr.Y)
+    }
+}
+
+func TestRunTimeout(t *testing.T) {
+    ctx, cancel := context.WithTimeout(context.Background(), 50 * time.Millisecond)
+    defer cancel()
+    start := time.Now()
+    _, err := Run(ctx, loopingProgram(t), strings.NewReader(""), &strings.Builder{}, Options{Capacity: 16})
+    if _, ok := err.(LimitError); !ok || !errors.Is(err, context.DeadlineExceeded) {
+        t.Fatalf("Expected the timeout to stop the program, got %v", err)
+    }
+    if elapsed := time.Since(start); elapsed > 5 * time.Second {
+        t.Errorf("Expected the program to stop soon after the timeout, took %s", elapsed)
+    }
+}
+
+func TestCompileTimeout(t *testing.T) {
+    ctx, cancel := context.WithTimeout(context.Background(), 50 * time.Millisecond)
+    defer cancel()
+    err := Compile(ctx, loopingProgram(t), &strings.Builder{}, Options{Capacity: 16})
+    if !errors.Is(err, context.DeadlineExceeded) {
+        t.Fatalf("Expected the timeout to stop the trace, got %v", err)
+    }
+    err = Compile(context.Background(), loopingProgram(t), &strings.Builder{}, Options{Capacity: 16, MaxSteps: 100})
+    if !errors.Is(err, ErrMaxSteps) {
+        t.Errorf("Expected the step limit to stop the trace, got %v", err)
+    }
+}
+
+func TestRunStackOverflow(t *testing.T) {
+    // 1 1 1 dup with room for three values
+    prog := Parse(Tokenize(linearProgram(Push, Push, Push, Dup)))
+    _, err := Run(context.Background(), prog, strings.NewReader(""), &strings.Builder{}, Options{Capacity: 3})
+    pietErr, ok := err.(Error)
+    if !ok {
+        t.Fatalf("Expected an Error, got %v", err)
+    }
+    if pietErr.Op != Dup || pietErr.X != 4 || pietErr.Y != 0 || pietErr.Reason != "stack overflow" {
+        t.Errorf("Expected the dup at (4, 0) to overflow, got %s", pietErr)
+    }
+
+    var output strings.Builder
+    if result, err := Run(context.Background(), prog, strings.NewReader(""), &output, Options{Capacity: 5}); err != nil || !result.Exited {
+        t.Errorf("Expected the program to fit in five values, got %v %v", result, err)
+    }
+}
+
+func TestCompileTraps(t *testing.T) {
+    img, err := ReadImage("../examples/Piet_Hello_World.gif")
+    if err != nil {
+        t.Fatal(err)
+    }
+    prog, err := Load(img, 0)
+    if err != nil {
+        t.Fatal(err)
+    }
+    cases := []struct {
+        name string
+        opts Options
+        trap string
+    }{
+        {"overflow", Options{Capacity: 1}, `Trap "push at (3, 0) dp right cc left: stack overflow"`},
+        {"strict", Options{Capacity: 512, Strict: true}, `Trap "switch at (1, 0) dp right cc left: stack underflow"`},
+    }
+    for _, c := range cases {
+        var asm strings.Builder
+        if err := Compile(context.Background(), prog, &asm, c.opts); err != nil {
+            t.Fatal(err)
+        }
+        main := asm.String()[strings.Index(asm.String(), "\n_main:"):]
+        main = main[:strings.Index(main, "section .bss")]
+        lines := strings.Split(strings.TrimSpace(main), "\n")
+        if last := strings.TrimSpace(lines[len(lines) - 1]); last != "Exit" {
+            t.Errorf("%s: expected _main to end with Exit, got %q", c.name, last)
+        }
+        instrs := []string{}
+        for _, line := range lines {
+            if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, ";") {
+                instrs = append(instrs, line)
+            }
+        }
+        if trap := instrs[len(instrs) - 2]; trap != c.trap {
+            t.Errorf("%s: expected the trace to end with %s, got %s", c.name, c.trap, trap)
+        }
+    }
+}
+
+// cancelWriter cancels its context at the first write.
+type cancelWriter struct {
+    strings.Builder
+    cancel context.CancelFunc
+}
+func (w *cancelWriter) Write(p []byte) (int, error) {
+    w.cancel()
+    return w.Builder.Write(p)
+}
+
+func TestRunStreamsOutput(t *testing.T) {
+    // push and print 1 forever, there is no trace to build first
+    img := NewPietImage(3, 1)
+    img.Set(0, 0, LightRed)
+    img.Set(1, 0, LightRed.Next(Push))
+    img.Set(2, 0, LightRed.Next(Push).Next(NumOut))
+    for _, optimize := range []int{0, 2} {
+        ctx, cancel := context.WithTimeout(context.Background(), 10 * time.Second)
+        output := cancelWriter{cancel: cancel}
+        _, err := Run(ctx, Parse(Tokenize(img)), strings.NewReader(""), &output, Options{Capacity: 16, Optimize: optimize})
+        if !errors.Is(err, context.Canceled) || !strings.HasPrefix(output.String(), "1") {
+            t.Errorf("-O%d: Expected the run to be cancelled once it printed, got %q %v", optimize, output.String(), err)
+        }
+        cancel()
+    }
+}
+
+func TestRunTurnsWithInput(t *testing.T) {
+    // in(number) dup pointer, then right prints the value and down pushes
+    img := NewPietImage(5, 2)
+    img.SetRect(img.Bounds(), Black)
+    img.Set(0, 0, LightRed)
+    img.Set(1, 0, LightRed.Next(NumIn))
+    img.Set(2, 0, img.Col(1, 0).Next(Dup))
+    img.Set(3, 0, img.Col(2, 0).Next(Pointer))
+    img.Set(4, 0, img.Col(3, 0).Next(NumOut))
+    img.Set(3, 1, img.Col(3, 0).Next(Push))
+    prog := Parse(Tokenize(img))
+    cases := []struct {
+        input string
+        expected string
+    }{
+        {"0", "0"},
+        {"1", ""},
+        {"", ""},
+    }
+    for _, c := range cases {
+        var output strings.Builder
+        Run(context.Background(), prog, strings.NewReader(c.input), &output, Options{Capacity: 16, MaxSteps: 4})
+        if output.String() != c.expected {
+            t.Errorf("%q: Expected %q got %q", c.input, c.expected, output.String())
+        }
+    }
+}
@@ -0,0 +1,178 @@
+package piet
+
+import "testing"
+
+func TestEmptyPop(t *testing.T) {
+    s := NewStack(3)
+
+    _, ok := s.Pop()
+    if ok {
+        t.Errorf("Pop on empty stack should have returned false")
+    }
+}
+
+func TestPop2NotEnoughItems(t *testing.T) {
+    s := NewStack(3)
+
+    _, _, ok := s.Pop2()
+    if ok {
+        t.Errorf("Pop2 on empty stack should have returned false")
+    }
+
+    s.Push(1)
+    _, _, ok = s.Pop2()
+    if ok {
+        t.Errorf("Pop2 on single item stack should have returned false")
+    }
+
+}
+
+func TestPop2(t *testing.T) {
+    s := NewStack(3)
+    s.Push(1)
+    s.Push(2)
+
+    first, second, ok := s.Pop2()
+    if !ok {
+        t.Errorf("Pop2 on two item stack returned false")
+    }
+    if first != 2 {
+        t.Errorf("Expected %d for first item. Got %d", 2, first)
+    }
+    if second != 1 {
+        t.Errorf("Expected %d for second item. Got %d", 1, second)
+    }
+}
+
+func TestPushAndPop (t *testing.T) {
+    const v1 = 10
+    const v2 = 20
+    s := NewStack(3) 
+    s.Push(v1)
+    s.Push(v2)
+
+    got, ok := s.Pop()
+    if !ok {
+        t.Errorf("Pop was unsuccessful")
+    } else if got != v2 {
+        t.Errorf("Got %d expected %d", got, v2)
+    }
+
+    got, ok = s.Pop()
+    if !ok {
+        t.Errorf("Pop was unsuccessful")
+    } else if got != v1 {
+        t.Errorf("Got %d expected %d", got, v1)
+    }
+
+}
+
+
+// naiveRoll buries the top value one step at a time.
+func naiveRoll(values []int32, depth int32, rolls int32) []int32 {
+    result := append([]int32{}, values...)
+    if depth < 0 || int(depth) > len(values) {
+        return append(result, depth, rolls)
+    }
+    if depth == 0 {
+        return result
+    }
+    for rolls < 0 {
+        rolls += depth
+    }
+    n := len(result)
+    for i := int32(0); i < rolls % depth; i++ {
+        top := result[n - 1]
+        copy(result[n - int(depth) + 1:], result[n - int(depth):n - 1])
+        result[n - int(depth)] = top
+    }
+    return result
+}
+
+func TestRoll(t *testing.T) {
+    for size := 0; size <= 6; size++ {
+        for depth := int32(-2); depth <= 8; depth++ {
+            for rolls := int32(-13); rolls <= 13; rolls++ {
+                values := []int32{}
+                s := NewStack(16)
+                for i := 0; i < size; i++ {
+                    values = append(values, int32(i + 1))
+                    s.Push(int32(i + 1))
+                }
+                expected := NewStack(16)
+                for _, v := range naiveRoll(values, depth, rolls) {
+                    expected.Push(v)
+                }
+                if !s.Roll(depth, rolls) {
+                    s.Push(depth)
+                    s.Push(rolls)
+                }
+                if s.String() != expected.String() {
+                    t.Errorf("Roll %v depth %d rolls %d: expected %s got %s", values, depth, rolls, expected, s)
+                }
+            }
+        }
+    }
+}
+
+func TestRollIgnored(t *testing.T) {
+    s := NewStack(8)
+    s.Push(1)
+    s.Push(2)
+    if s.Roll(3, 1) {
+        t.Errorf("Rolling deeper than the stack should be ignored")
+    }
+    if s.Roll(-1, 1) {
+        t.Errorf("Rolling to a negative depth should be ignored")
+    }
+    if s.String() != "[1, 2]" {
+        t.Errorf("An ignored roll should leave the stack alone, got %s", s)
+    }
+}
+
+func TestReverse(t *testing.T) {
+    for size := 0; size <= 6; size++ {
+        s := NewStack(8)
+        for i := 0; i < size; i++ {
+            s.Push(int32(i))
+        }
+        s.Reverse(0, size)
+        for i := 0; i < size; i++ {
+            if got := s.data[i]; got != int32(size - 1 - i) {
+                t.Errorf("Reverse of %d values: expected %d at %d got %d", size, size - 1 - i, i, got)
+            }
+        }
+    }
+}
+
+func TestStackGrows(t *testing.T) {
+    s := NewStack(0)
+    for i := 0; i < 1000; i++ {
+        if !s.Push(int32(i)) {
+            t.Fatalf("Push %d failed on a stack without a limit", i)
+        }
+    }
+    for i := 999; i >= 0; i-- {
+        if got, ok := s.Pop(); !ok || got != int32(i) {
+            t.Fatalf("Expected %d got %d", i, got)
+        }
+    }
+}
+
+func TestStackCapacity(t *testing.T) {
+    s := NewStack(100)
+    for i := 0; i < 100; i++ {
+        if !s.Push(int32(i)) {
+            t.Fatalf("Push %d failed below the capacity", i)
+        }
+    }
+    if s.Push(100) {
+        t.Errorf("Push should fail once the stack is full")
+    }
+    if s.Dup() {
+        t.Errorf("Dup should fail once the stack is full")
+    }
+    if s.Len() != 100 {
+        t.Errorf("A failed push should leave the stack alone, got %d values", s.Len())
+    }
+}